@@ -0,0 +1,198 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// ApplyOptions configures how the transport mutates server-side apply requests, whose body is the applied
+// configuration of the caller rather than a full object.
+type ApplyOptions struct {
+	// FieldManager owns the fields set by overrides. If it is empty, overrides are merged into the applied
+	// configuration of the caller on purpose, so the field manager of the caller owns them.
+	//
+	// If it is set, the transport applies the fields set by overrides with FieldManager after the request of the caller
+	// succeeds, forcing conflicts. The caller applies its own configuration, except that a new object is created with
+	// the overrides too, so the fields are shared with the caller until it applies again. The fields are owned by
+	// another manager, so they can not be applied by the same request: other clients may see the object without the
+	// overrides of an update until they are applied. If they fail to apply, the failure policy decides whether the
+	// request fails, after the configuration of the caller is applied.
+	FieldManager string
+}
+
+// isApplyPatch returns true if contentType is the content type of server-side apply requests.
+func isApplyPatch(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && types.PatchType(mediaType) == types.ApplyPatchType
+}
+
+// mutateApply applies override policies on the applied configuration of a server-side apply request. Besides the new
+// body, it returns the applied configuration of the fields set by overrides if they are owned by
+// ApplyOptions.FieldManager, see applyOverrideFields.
+func (tr *policyTransport) mutateApply(req *http.Request, info *RequestInfo, body []byte, rec *mutationRecord) ([]byte, []byte, error) {
+	codec := yamlCodec{}
+	intent, err := codec.decode(body)
+	if err != nil {
+		klog.V(4).InfoS("skip mutating undecodable apply patch.", "url", info.Path, "err", err)
+		return body, nil, nil
+	}
+	defaultNamespace(intent, info)
+
+	rec.gvk = intent.GroupVersionKind()
+
+	// excluded objects are sent untouched, but they are validated still.
+	reason := tr.exclusions.excluded(intent, info.Namespace)
+	if len(reason) != 0 {
+		klog.V(4).InfoS("skip mutating excluded object.", "url", info.Path, "reason", reason)
+		if tr.validateManager == nil {
+			return body, nil, nil
+		}
+	}
+
+	current := tr.objectCache.get(info)
+	if current == nil {
+		if current, err = tr.getCurrentObject(req); err != nil {
+			return nil, nil, err
+		}
+	}
+	// apply creates the object if it does not exist.
+	operation := admissionv1.Update
+	if current == nil {
+		operation = admissionv1.Create
+	}
+
+	mutated := intent.DeepCopy()
+	if len(reason) == 0 {
+		if err = tr.mutate(req.Context(), info, mutated, current, operation, rec); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if err = tr.validate(req.Context(), info, mutated, current, operation); err != nil {
+		return nil, nil, err
+	}
+
+	if len(reason) != 0 {
+		return body, nil, nil
+	}
+
+	if len(tr.applyOptions.FieldManager) == 0 {
+		newBody, err := codec.encode(mutated)
+		return newBody, nil, err
+	}
+
+	return splitOverrideFields(intent, mutated, current == nil)
+}
+
+// splitOverrideFields splits the changes overrides made on the applied configuration intent. It returns the
+// configuration applied by the caller, which drops the fields removed by overrides, and the configuration of the
+// fields set by overrides. Lists are set as a whole. If created is true, the caller creates the object with the
+// fields set by overrides too.
+func splitOverrideFields(intent, mutated *unstructured.Unstructured, created bool) ([]byte, []byte, error) {
+	intentBytes, err := intent.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	mutatedBytes, err := mutated.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	patchBytes, err := jsonpatch.CreateMergePatch(intentBytes, mutatedBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	var patch map[string]interface{}
+	if err = json.Unmarshal(patchBytes, &patch); err != nil {
+		return nil, nil, err
+	}
+
+	set, removed := splitMergePatch(patch)
+	if len(set) == 0 {
+		return mutatedBytes, nil, nil
+	}
+
+	callerBytes := mutatedBytes
+	if !created {
+		removedBytes, err := json.Marshal(removed)
+		if err != nil {
+			return nil, nil, err
+		}
+		if callerBytes, err = jsonpatch.MergePatch(intentBytes, removedBytes); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fields := &unstructured.Unstructured{Object: set}
+	fields.SetAPIVersion(intent.GetAPIVersion())
+	fields.SetKind(intent.GetKind())
+	fields.SetName(intent.GetName())
+	fields.SetNamespace(intent.GetNamespace())
+	fieldsBytes, err := fields.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return callerBytes, fieldsBytes, nil
+}
+
+// splitMergePatch splits a json merge patch into the fields it sets and the fields it removes.
+func splitMergePatch(patch map[string]interface{}) (set, removed map[string]interface{}) {
+	set, removed = map[string]interface{}{}, map[string]interface{}{}
+	for key, value := range patch {
+		switch v := value.(type) {
+		case nil:
+			removed[key] = nil
+		case map[string]interface{}:
+			nestedSet, nestedRemoved := splitMergePatch(v)
+			if len(nestedSet) != 0 {
+				set[key] = nestedSet
+			}
+			if len(nestedRemoved) != 0 {
+				removed[key] = nestedRemoved
+			}
+		default:
+			set[key] = v
+		}
+	}
+
+	return set, removed
+}
+
+// applyOverrideFields applies the fields set by overrides with ApplyOptions.FieldManager after the request of the
+// caller succeeds, and returns its response. Failing to apply them is handled by the failure policy by the caller.
+func (tr *policyTransport) applyOverrideFields(req *http.Request, fields []byte) (*http.Response, error) {
+	u := *req.URL
+	query := u.Query()
+	query.Set("fieldManager", tr.applyOptions.FieldManager)
+	query.Set("force", "true")
+	u.RawQuery = query.Encode()
+
+	applyReq, err := http.NewRequestWithContext(req.Context(), http.MethodPatch, u.String(), bytes.NewReader(fields))
+	if err != nil {
+		return nil, err
+	}
+	applyReq.Header = req.Header.Clone()
+
+	applyResp, err := tr.delegate.RoundTrip(applyReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply fields set by overrides: %w", err)
+	}
+	if applyResp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(applyResp.Body)
+		applyResp.Body.Close()
+		return nil, fmt.Errorf("failed to apply fields set by overrides: status %d: %s", applyResp.StatusCode, body)
+	}
+
+	return applyResp, nil
+}
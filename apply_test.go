@@ -0,0 +1,286 @@
+package pidalio
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/structured-merge-diff/v4/fieldpath"
+	"sigs.k8s.io/structured-merge-diff/v4/merge"
+	"sigs.k8s.io/structured-merge-diff/v4/typed"
+	"sigs.k8s.io/yaml"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// applyServer serves server-side apply requests of a single object like the apiserver, with the deduced schema of
+// structured-merge-diff.
+type applyServer struct {
+	t       *testing.T
+	live    *typed.TypedValue
+	managed fieldpath.ManagedFields
+}
+
+type sameVersionConverter struct{}
+
+func (sameVersionConverter) Convert(object *typed.TypedValue, _ fieldpath.APIVersion) (*typed.TypedValue, error) {
+	return object, nil
+}
+
+func (sameVersionConverter) IsMissingVersionError(error) bool {
+	return false
+}
+
+func (s *applyServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == http.MethodGet {
+		if s.live == nil {
+			return newResponse(http.StatusNotFound, nil), nil
+		}
+		body, err := yaml.YAMLToJSON([]byte(s.liveYAML()))
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		return newResponse(http.StatusOK, body), nil
+	}
+
+	body, _ := ioutil.ReadAll(req.Body)
+	config, err := typed.DeducedParseableType.FromYAML(typed.YAMLObject(body))
+	if err != nil {
+		s.t.Fatalf("invalid applied configuration: %v", err)
+	}
+
+	status := http.StatusOK
+	live := s.live
+	if live == nil {
+		status = http.StatusCreated
+		if live, err = typed.DeducedParseableType.FromUnstructured(map[string]interface{}{}); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+
+	updater := &merge.Updater{Converter: sameVersionConverter{}}
+	query := req.URL.Query()
+	newLive, managed, err := updater.Apply(live, config, "v1", s.managed, query.Get("fieldManager"), query.Get("force") == "true")
+	if err != nil {
+		return newResponse(http.StatusConflict, []byte(err.Error())), nil
+	}
+	if newLive != nil {
+		s.live = newLive
+	}
+	s.managed = managed
+
+	return newResponse(status, []byte(`{}`)), nil
+}
+
+func (s *applyServer) liveYAML() string {
+	out, err := yaml.Marshal(s.live.AsValue().Unstructured())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return string(out)
+}
+
+// owners returns the managers owning the field at path.
+func (s *applyServer) owners(path ...interface{}) []string {
+	var owners []string
+	for manager, set := range s.managed {
+		if set.Set().Has(fieldpath.MakePathOrDie(path...)) {
+			owners = append(owners, manager)
+		}
+	}
+	return owners
+}
+
+func TestPolicyTransport_RoundTripApply(t *testing.T) {
+	source, err := lister.NewMemoryPolicySource(&policyv1alpha1.ClusterOverridePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "spot"},
+		Spec: policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create, admissionv1.Update},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{
+							{Path: "/metadata/labels/spot", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"true"`)}},
+							{Path: "/data/debug", Operator: "remove"},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copLister := lister.NewClusterOverridePolicyLister(source)
+	opLister := lister.NewOverridePolicyLister(source)
+
+	intent := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n  namespace: default\n  labels:\n    app: web\ndata:\n  key: value\n  debug: \"true\"\n"
+
+	tests := []struct {
+		name         string
+		fieldManager string
+		applies      int
+		// wantOwners are the managers of label spot after every apply.
+		wantOwners []string
+	}{
+		{
+			name:       "create owned by caller",
+			applies:    1,
+			wantOwners: []string{"caller"},
+		},
+		{
+			name:       "update owned by caller",
+			applies:    2,
+			wantOwners: []string{"caller"},
+		},
+		{
+			name:         "create shared with field manager",
+			fieldManager: "pidalio",
+			applies:      1,
+			wantOwners:   []string{"caller", "pidalio"},
+		},
+		{
+			name:         "update owned by field manager",
+			fieldManager: "pidalio",
+			applies:      2,
+			wantOwners:   []string{"pidalio"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &applyServer{t: t}
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					applyOptions:      ApplyOptions{FieldManager: tt.fieldManager},
+				},
+				delegate: server,
+			}
+
+			for i := 0; i < tt.applies; i++ {
+				req, _ := http.NewRequest(http.MethodPatch,
+					"https://127.0.0.1/api/v1/namespaces/default/configmaps/cm?fieldManager=caller", bytes.NewBufferString(intent))
+				req.Header.Set("Content-Type", string(types.ApplyPatchType))
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("RoundTrip() error = %v", err)
+				}
+				if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+					body, _ := ioutil.ReadAll(resp.Body)
+					t.Fatalf("RoundTrip() status = %d, body = %s", resp.StatusCode, body)
+				}
+			}
+
+			live := server.live.AsValue().Unstructured().(map[string]interface{})
+			labels, _ := live["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+			if labels["spot"] != "true" {
+				t.Errorf("live object = %s, want label spot", server.liveYAML())
+			}
+			if _, ok := live["data"].(map[string]interface{})["debug"]; ok {
+				t.Errorf("live object = %s, want data debug removed", server.liveYAML())
+			}
+
+			owners := server.owners("metadata", "labels", "spot")
+			if fmt.Sprint(sets.NewString(owners...).List()) != fmt.Sprint(tt.wantOwners) {
+				t.Errorf("owners of label spot = %v, want %v", owners, tt.wantOwners)
+			}
+			if owners := server.owners("data", "key"); fmt.Sprint(owners) != "[caller]" {
+				t.Errorf("owners of data key = %v, want [caller]", owners)
+			}
+		})
+	}
+}
+
+func TestPolicyTransport_RoundTripApplyFieldsFailure(t *testing.T) {
+	source, err := lister.NewMemoryPolicySource(&policyv1alpha1.ClusterOverridePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "spot"},
+		Spec: policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create, admissionv1.Update},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{
+							{Path: "/metadata/labels/spot", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"true"`)}},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copLister := lister.NewClusterOverridePolicyLister(source)
+	opLister := lister.NewOverridePolicyLister(source)
+
+	intent := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n  namespace: default\n  labels:\n    app: web\ndata:\n  key: value\n"
+
+	tests := []struct {
+		name          string
+		failurePolicy FailurePolicyType
+		wantCode      int
+	}{
+		{
+			name:          "fail",
+			failurePolicy: Fail,
+			wantCode:      http.StatusInternalServerError,
+		},
+		{
+			name:          "ignore",
+			failurePolicy: Ignore,
+			wantCode:      http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					applyOptions:      ApplyOptions{FieldManager: "pidalio"},
+					failurePolicy: &failurePolicyResolver{
+						defaultPolicy: tt.failurePolicy,
+						copLister:     copLister,
+						opLister:      opLister,
+					},
+				},
+				delegate: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					switch {
+					case req.Method == http.MethodGet:
+						return newResponse(http.StatusOK, []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}`)), nil
+					case req.URL.Query().Get("fieldManager") == "pidalio":
+						return nil, errors.New("connection reset")
+					default:
+						return newResponse(http.StatusOK, []byte(`{}`)), nil
+					}
+				}),
+			}
+
+			req, _ := http.NewRequest(http.MethodPatch,
+				"https://127.0.0.1/api/v1/namespaces/default/configmaps/cm?fieldManager=caller", bytes.NewBufferString(intent))
+			req.Header.Set("Content-Type", string(types.ApplyPatchType))
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				body, _ := ioutil.ReadAll(resp.Body)
+				t.Errorf("RoundTrip() status = %d, body = %s, want %d", resp.StatusCode, body, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package pidalio
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/transport"
+	"k8s.io/klog/v2"
+)
+
+// ClientSelectorAnnotation on a (Cluster)OverridePolicy selects the clients whose requests the policy applies on,
+// it is a json encoded ClientSelector, e.g. {"clientNames":["batch-tool"]}.
+const ClientSelectorAnnotation = "policy.kcloudlabs.io/client-selector"
+
+// ClientIdentity identifies the client sending a request.
+type ClientIdentity struct {
+	// ClientName is the client name set by Options.ClientName.
+	ClientName string
+	// UserAgent is the User-Agent header of the request.
+	UserAgent string
+	// Username is the user impersonated by the request, or the basic auth user of the rest.Config otherwise.
+	Username string
+	// FieldManager is the fieldManager query parameter of the request.
+	FieldManager string
+}
+
+// ClientSelector selects clients by their ClientIdentity. A client is selected if it matches every field set,
+// and it matches a field if it matches any of the values.
+type ClientSelector struct {
+	ClientNames []string `json:"clientNames,omitempty"`
+	// UserAgentPrefixes match the prefix of user agents, which usually carry the version of clients,
+	// e.g. "kubectl/" matches "kubectl/v1.23.6 (linux/amd64) kubernetes/ad33385".
+	UserAgentPrefixes []string `json:"userAgentPrefixes,omitempty"`
+	Usernames         []string `json:"usernames,omitempty"`
+	FieldManagers     []string `json:"fieldManagers,omitempty"`
+}
+
+// Matches returns true if identity is selected.
+func (s *ClientSelector) Matches(identity ClientIdentity) bool {
+	return matchesAny(s.ClientNames, identity.ClientName, false) &&
+		matchesAny(s.UserAgentPrefixes, identity.UserAgent, true) &&
+		matchesAny(s.Usernames, identity.Username, false) &&
+		matchesAny(s.FieldManagers, identity.FieldManager, false)
+}
+
+func matchesAny(values []string, value string, prefix bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if v == value || (prefix && strings.HasPrefix(value, v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithClientIdentity returns a copy of ctx which makes the transport apply policies as if identity sends the request,
+// instead of the identity built from the request. It also sets the identity of Transport.Explain.
+func WithClientIdentity(ctx context.Context, identity ClientIdentity) context.Context {
+	scope := policyScopeFrom(ctx).copy()
+	scope.client = &identity
+	return context.WithValue(ctx, policyScopeKey, scope)
+}
+
+// clientIdentity builds the identity of the client sending req.
+func (e *policyEngine) clientIdentity(req *http.Request) ClientIdentity {
+	identity := ClientIdentity{
+		ClientName:   e.clientName,
+		UserAgent:    req.Header.Get("User-Agent"),
+		Username:     e.username,
+		FieldManager: req.URL.Query().Get("fieldManager"),
+	}
+	if user := req.Header.Get(transport.ImpersonateUserHeader); len(user) != 0 {
+		identity.Username = user
+	}
+
+	return identity
+}
+
+// matchesClient returns true if the client selector of policy selects identity. A policy without client selector
+// selects every client, and a policy with an invalid one selects none. The selector is looked up from selectors,
+// it is parsed if it is not cached.
+func matchesClient(policy metav1.Object, identity ClientIdentity, selectors *clientSelectors) bool {
+	value, ok := policy.GetAnnotations()[ClientSelectorAnnotation]
+	if !ok {
+		return true
+	}
+
+	selector, ok := selectors.get(policyKey(policy), value)
+	if !ok {
+		selector = parseClientSelector(policy, value)
+	}
+	return selector != nil && selector.Matches(identity)
+}
+
+// parseClientSelector parses the client selector annotation value of policy, it returns nil if it is invalid.
+func parseClientSelector(policy metav1.Object, value string) *ClientSelector {
+	selector := &ClientSelector{}
+	if err := json.Unmarshal([]byte(value), selector); err != nil {
+		klog.ErrorS(err, "Invalid client selector, the policy selects no client.", "policy", klog.KObj(policy))
+		return nil
+	}
+	return selector
+}
+
+// clientSelectors caches the client selectors of the (Cluster)OverridePolicies watched from the apiserver, which is
+// updated by informer events. So requests neither list policies to know whether any policy selects clients, nor
+// parse the selectors again.
+type clientSelectors struct {
+	lock sync.RWMutex
+	// selectors are keyed by policyKey, invalid selectors are cached as nil.
+	selectors map[string]cachedClientSelector
+}
+
+type cachedClientSelector struct {
+	// value is the annotation value parsed.
+	value    string
+	selector *ClientSelector
+}
+
+func newClientSelectors() *clientSelectors {
+	return &clientSelectors{selectors: make(map[string]cachedClientSelector)}
+}
+
+// update caches the client selector of policy, or drops it if policy has none.
+func (c *clientSelectors) update(obj interface{}) {
+	policy, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	key := policyKey(policy)
+	value, ok := policy.GetAnnotations()[ClientSelectorAnnotation]
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !ok {
+		delete(c.selectors, key)
+		return
+	}
+	if cached, ok := c.selectors[key]; ok && cached.value == value {
+		return
+	}
+	c.selectors[key] = cachedClientSelector{value: value, selector: parseClientSelector(policy, value)}
+}
+
+// delete drops the client selector of a deleted policy.
+func (c *clientSelectors) delete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	policy, err := meta.Accessor(obj)
+	if err != nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.selectors, policyKey(policy))
+}
+
+// any returns true if any policy has a client selector.
+func (c *clientSelectors) any() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.selectors) != 0
+}
+
+// get returns the cached selector of the policy with key, which is nil if it is invalid. It returns false if the
+// selector parsed from value is not cached.
+func (c *clientSelectors) get(key, value string) (*ClientSelector, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	cached, ok := c.selectors[key]
+	if !ok || cached.value != value {
+		return nil, false
+	}
+	return cached.selector, true
+}
+
+// addClientSelectorEventHandlers keeps the client selectors of the policies watched up to date.
+func (s *setupManager) addClientSelectorEventHandlers() {
+	s.clientSelectors = newClientSelectors()
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: s.clientSelectors.update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.clientSelectors.update(newObj)
+		},
+		DeleteFunc: s.clientSelectors.delete,
+	}
+	s.addPolicyEventHandler(opGVR, handler)
+	s.addPolicyEventHandler(copGVR, handler)
+}
+
+// selectsClients returns true if any (Cluster)OverridePolicy selects clients, so the policies applied on a request
+// depend on its client. Policies are only listed if their client selectors are not cached, e.g. policies loaded
+// from files.
+func (e *policyEngine) selectsClients() bool {
+	if e.clientSelectors != nil {
+		return e.clientSelectors.any()
+	}
+	if e.copLister == nil || e.opLister == nil {
+		return false
+	}
+
+	cops, err := e.copLister.List(labels.Everything())
+	if err != nil {
+		return true
+	}
+	for _, cop := range cops {
+		if _, ok := cop.Annotations[ClientSelectorAnnotation]; ok {
+			return true
+		}
+	}
+
+	ops, err := e.opLister.List(labels.Everything())
+	if err != nil {
+		return true
+	}
+	for _, op := range ops {
+		if _, ok := op.Annotations[ClientSelectorAnnotation]; ok {
+			return true
+		}
+	}
+
+	return false
+}
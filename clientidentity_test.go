@@ -0,0 +1,224 @@
+package pidalio
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestPolicyTransport_RoundTripClientSelector(t *testing.T) {
+	newSpec := func(label string) policyv1alpha1.OverridePolicySpec {
+		return policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{
+							{
+								Path:     "/metadata/labels/" + label,
+								Operator: "add",
+								Value:    apiextensionsv1.JSON{Raw: []byte(`"true"`)},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+	newPolicy := func(name, selector string) *policyv1alpha1.ClusterOverridePolicy {
+		return &policyv1alpha1.ClusterOverridePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: map[string]string{ClientSelectorAnnotation: selector}},
+			Spec:       newSpec(name),
+		}
+	}
+
+	source, err := lister.NewMemoryPolicySource(
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "all"}, Spec: newSpec("all")},
+		newPolicy("batch", `{"clientNames":["batch-tool"]}`),
+		newPolicy("kubectl", `{"userAgentPrefixes":["kubectl/"]}`),
+		newPolicy("admin", `{"usernames":["admin"],"fieldManagers":["kubectl-create"]}`),
+		newPolicy("invalid", `{"clientNames":`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copLister := lister.NewClusterOverridePolicyLister(source)
+	opLister := lister.NewOverridePolicyLister(source)
+	// selectors cached as if they are updated by informer events.
+	selectors := newClientSelectors()
+	for _, obj := range source.Indexer(lister.ClusterOverridePolicyResource).List() {
+		selectors.update(obj)
+	}
+
+	tests := []struct {
+		name         string
+		clientName   string
+		config       rest.Config
+		ctx          context.Context
+		fieldManager string
+		cached       bool
+		wantLabels   []string
+	}{
+		{
+			name:       "no client selected",
+			ctx:        context.Background(),
+			wantLabels: []string{"all"},
+		},
+		{
+			name:       "client name",
+			clientName: "batch-tool",
+			ctx:        context.Background(),
+			wantLabels: []string{"all", "batch"},
+		},
+		{
+			name:       "cached client selectors",
+			clientName: "batch-tool",
+			config:     rest.Config{UserAgent: "kubectl/v1.23.6 (linux/amd64) kubernetes/ad33385"},
+			ctx:        context.Background(),
+			cached:     true,
+			wantLabels: []string{"all", "batch", "kubectl"},
+		},
+		{
+			name:       "user agent prefix",
+			config:     rest.Config{UserAgent: "kubectl/v1.23.6 (linux/amd64) kubernetes/ad33385"},
+			ctx:        context.Background(),
+			wantLabels: []string{"all", "kubectl"},
+		},
+		{
+			name:         "impersonated user and field manager",
+			config:       rest.Config{Impersonate: rest.ImpersonationConfig{UserName: "admin"}},
+			ctx:          context.Background(),
+			fieldManager: "kubectl-create",
+			wantLabels:   []string{"all", "admin"},
+		},
+		{
+			name:       "impersonated user without field manager",
+			config:     rest.Config{Impersonate: rest.ImpersonationConfig{UserName: "admin"}},
+			ctx:        context.Background(),
+			wantLabels: []string{"all"},
+		},
+		{
+			name:         "basic auth user",
+			config:       rest.Config{Username: "admin", Password: "secret"},
+			ctx:          context.Background(),
+			fieldManager: "kubectl-create",
+			wantLabels:   []string{"all", "admin"},
+		},
+		{
+			name:       "identity from context",
+			clientName: "batch-tool",
+			ctx:        WithClientIdentity(context.Background(), ClientIdentity{UserAgent: "kubectl/v1.23.6"}),
+			wantLabels: []string{"all", "kubectl"},
+		},
+		{
+			name:       "client selector and only policies",
+			clientName: "batch-tool",
+			ctx:        WithOnlyPolicies(context.Background(), "batch"),
+			wantLabels: []string{"batch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := &policyEngine{
+				initialized:       1,
+				overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+				policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+				copLister:         copLister,
+				opLister:          opLister,
+				clientName:        tt.clientName,
+				username:          tt.config.Username,
+			}
+			if tt.cached {
+				engine.clientSelectors = selectors
+			}
+
+			var sent *appsv1.Deployment
+			config := tt.config
+			config.Host = "https://127.0.0.1:6443"
+			config.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				obj, err := bytesToUnstructured(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sent = &appsv1.Deployment{}
+				sent.SetLabels(obj.GetLabels())
+				return newResponse(http.StatusCreated, body), nil
+			})
+			config.Wrap(engine.Wrap)
+			client := kubernetes.NewForConfigOrDie(&config)
+
+			deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"app": "web"}}}
+			if _, err := client.AppsV1().Deployments("default").Create(tt.ctx, deployment, metav1.CreateOptions{FieldManager: tt.fieldManager}); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			got := sent.GetLabels()
+			if len(got) != len(tt.wantLabels)+1 {
+				t.Errorf("labels = %v, want %v", got, tt.wantLabels)
+			}
+			for _, label := range tt.wantLabels {
+				if got[label] != "true" {
+					t.Errorf("labels = %v, want %v", got, tt.wantLabels)
+				}
+			}
+		})
+	}
+}
+
+func TestClientSelectors(t *testing.T) {
+	newPolicy := func(selector string) *unstructured.Unstructured {
+		policy := &unstructured.Unstructured{}
+		policy.SetNamespace("default")
+		policy.SetName("op")
+		if len(selector) != 0 {
+			policy.SetAnnotations(map[string]string{ClientSelectorAnnotation: selector})
+		}
+		return policy
+	}
+
+	selectors := newClientSelectors()
+	selectors.update(newPolicy(""))
+	if selectors.any() {
+		t.Error("any() = true for a policy without client selector")
+	}
+
+	selectors.update(newPolicy(`{"clientNames":["batch-tool"]}`))
+	if !selectors.any() {
+		t.Error("any() = false for a policy with client selector")
+	}
+	if selector, ok := selectors.get("default/op", `{"clientNames":["batch-tool"]}`); !ok || !selector.Matches(ClientIdentity{ClientName: "batch-tool"}) {
+		t.Errorf("get() = %v, %v, want the cached selector", selector, ok)
+	}
+	if _, ok := selectors.get("default/op", `{"clientNames":["other"]}`); ok {
+		t.Error("get() found a selector parsed from another value")
+	}
+
+	selectors.update(newPolicy(`invalid`))
+	if selector, ok := selectors.get("default/op", `invalid`); !ok || selector != nil {
+		t.Errorf("get() = %v, %v, want an invalid selector cached as nil", selector, ok)
+	}
+	if matchesClient(newPolicy(`invalid`), ClientIdentity{}, selectors) {
+		t.Error("matchesClient() = true for an invalid selector")
+	}
+
+	selectors.delete(cache.DeletedFinalStateUnknown{Key: "default/op", Obj: newPolicy(`invalid`)})
+	if selectors.any() {
+		t.Error("any() = true after the policy is deleted")
+	}
+}
@@ -0,0 +1,130 @@
+// pidalio-proxy is a local proxy to the apiserver like kubectl proxy. Every write sent through it is mutated by
+// (Cluster)OverridePolicies, so clients not written in go get the policies applied without code changes.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/k-cloud-labs/pidalio"
+)
+
+func main() {
+	var (
+		address              string
+		port                 int
+		kubeconfigOut        string
+		syncTimeout          time.Duration
+		failurePolicy        string
+		enableValidatePolicy bool
+		acceptHosts          string
+		rejectPaths          string
+		allowNonLoopback     bool
+	)
+	flag.StringVar(&address, "address", "127.0.0.1", "The IP address on which to serve.")
+	flag.BoolVar(&allowNonLoopback, "allow-non-loopback", false, "Allow serving on a non-loopback address, which exposes the credentials of the kubeconfig to the network.")
+	flag.StringVar(&acceptHosts, "accept-hosts", defaultAcceptHosts, "Comma separated regular expressions of the hosts to accept.")
+	flag.StringVar(&rejectPaths, "reject-paths", defaultRejectPaths, "Comma separated regular expressions of the paths to reject.")
+	flag.IntVar(&port, "port", 8001, "The port on which to serve, 0 picks a random port.")
+	flag.StringVar(&kubeconfigOut, "kubeconfig-out", "", "The file to write the kubeconfig pointing at the proxy to, it is printed to stdout if empty.")
+	flag.DurationVar(&syncTimeout, "sync-timeout", time.Minute, "The max duration to wait for policies to be synced.")
+	flag.StringVar(&failurePolicy, "failure-policy", string(pidalio.Fail), "How errors evaluating policies are handled, Ignore or Fail.")
+	flag.BoolVar(&enableValidatePolicy, "enable-validate-policy", false, "Reject requests denied by ClusterValidatePolicies.")
+	klog.InitFlags(flag.CommandLine)
+	flag.Parse()
+
+	if err := checkAddress(address, allowNonLoopback); err != nil {
+		klog.ErrorS(err, "invalid address.")
+		os.Exit(1)
+	}
+	filter, err := newProxyFilter(acceptHosts, rejectPaths)
+	if err != nil {
+		klog.ErrorS(err, "invalid filter.")
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := run(ctx, address, port, kubeconfigOut, filter, pidalio.Options{
+		SyncTimeout:          syncTimeout,
+		FailurePolicy:        pidalio.FailurePolicyType(failurePolicy),
+		EnableValidatePolicy: enableValidatePolicy,
+	}); err != nil {
+		klog.ErrorS(err, "proxy failed.")
+		os.Exit(1)
+	}
+}
+
+// checkAddress refuses non-loopback addresses unless allowNonLoopback is set.
+func checkAddress(address string, allowNonLoopback bool) error {
+	if allowNonLoopback || address == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(address); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("address %q is not a loopback address, set --allow-non-loopback to serve on it", address)
+}
+
+func run(ctx context.Context, address string, port int, kubeconfigOut string, filter *proxyFilter, opts pidalio.Options) error {
+	config := ctrl.GetConfigOrDie()
+
+	t, err := pidalio.New(config, opts)
+	if err != nil {
+		return fmt.Errorf("setup transport failed: %w", err)
+	}
+	if err = t.Start(ctx); err != nil {
+		return fmt.Errorf("start transport failed: %w", err)
+	}
+	defer t.Stop()
+
+	if err = t.WaitForSync(ctx); err != nil {
+		return fmt.Errorf("sync policies failed: %w", err)
+	}
+
+	handler, err := newProxyHandler(config, filter)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(address, fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+
+	kubeconfig, err := proxyKubeconfig("http://" + l.Addr().String())
+	if err != nil {
+		return err
+	}
+	if len(kubeconfigOut) == 0 {
+		fmt.Print(string(kubeconfig))
+	} else if err = os.WriteFile(kubeconfigOut, kubeconfig, 0600); err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	klog.InfoS("Starting to serve.", "address", l.Addr().String())
+	if err = server.Serve(l); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
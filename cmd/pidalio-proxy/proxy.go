@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"path"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/klog/v2"
+)
+
+const (
+	proxyName = "pidalio-proxy"
+
+	// defaultAcceptHosts and defaultRejectPaths are the defaults of kubectl proxy.
+	defaultAcceptHosts = `^localhost$,^127\.0\.0\.1$,^\[::1\]$`
+	defaultRejectPaths = `^/api/.*/pods/.*/exec,^/api/.*/pods/.*/attach,^/api/.*/pods/.*/portforward`
+)
+
+// proxyFilter rejects requests like the filter of kubectl proxy. The proxy sends its own credentials, so requests
+// for other hosts are rejected to defend against DNS rebinding from browsers.
+type proxyFilter struct {
+	acceptHosts []*regexp.Regexp
+	rejectPaths []*regexp.Regexp
+}
+
+// newProxyFilter returns a filter accepting the hosts matching any of the comma separated regular expressions
+// acceptHosts, and rejecting the paths matching any of rejectPaths.
+func newProxyFilter(acceptHosts, rejectPaths string) (*proxyFilter, error) {
+	f := &proxyFilter{}
+	var err error
+	if f.acceptHosts, err = compileRegexps(acceptHosts); err != nil {
+		return nil, fmt.Errorf("invalid accept hosts: %w", err)
+	}
+	if f.rejectPaths, err = compileRegexps(rejectPaths); err != nil {
+		return nil, fmt.Errorf("invalid reject paths: %w", err)
+	}
+	return f, nil
+}
+
+func compileRegexps(exprs string) ([]*regexp.Regexp, error) {
+	var regexps []*regexp.Regexp
+	for _, expr := range strings.Split(exprs, ",") {
+		if len(expr) == 0 {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+	return regexps, nil
+}
+
+func matchesAny(regexps []*regexp.Regexp, s string) bool {
+	for _, re := range regexps {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts returns true if the host of req is accepted and its path is not rejected.
+func (f *proxyFilter) accepts(req *http.Request) bool {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+	}
+	return matchesAny(f.acceptHosts, host) && !matchesAny(f.rejectPaths, req.URL.Path)
+}
+
+// wrap returns a handler rejecting the requests not accepted by the filter with 403.
+func (f *proxyFilter) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !f.accepts(req) {
+			klog.V(2).InfoS("rejected request.", "host", req.Host, "path", req.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// newProxyHandler returns a handler forwarding requests to the apiserver of config with its credentials.
+// Requests are sent through the transport built from config, so the policy transport registered to it mutates them.
+// Credentials sent by clients are dropped, the proxy always uses its own ones, so requests are filtered by filter.
+func newProxyHandler(config *rest.Config, filter *proxyFilter) (http.Handler, error) {
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	target, _, err := rest.DefaultServerURL(config.Host, "", schema.GroupVersion{}, rest.IsConfigTransportTLS(*config))
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+			req.URL.RawPath = ""
+			req.Host = ""
+			req.Header.Del("Authorization")
+		},
+		Transport: transport,
+		// flush immediately, so watches are streamed to clients.
+		FlushInterval: -1,
+	}
+
+	return filter.wrap(proxy), nil
+}
+
+func singleJoiningSlash(base, p string) string {
+	if len(base) == 0 {
+		return p
+	}
+
+	joined := path.Join(base, p)
+	if len(p) > 1 && p[len(p)-1] == '/' {
+		joined += "/"
+	}
+	return joined
+}
+
+// proxyKubeconfig returns a kubeconfig without credentials pointing at the proxy serving on server.
+func proxyKubeconfig(server string) ([]byte, error) {
+	config := clientcmdapi.NewConfig()
+	config.Clusters[proxyName] = &clientcmdapi.Cluster{Server: server}
+	config.AuthInfos[proxyName] = &clientcmdapi.AuthInfo{}
+	config.Contexts[proxyName] = &clientcmdapi.Context{Cluster: proxyName, AuthInfo: proxyName}
+	config.CurrentContext = proxyName
+
+	return clientcmd.Write(*config)
+}
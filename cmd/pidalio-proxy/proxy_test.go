@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func TestNewProxyHandler(t *testing.T) {
+	var gotPath, gotAuth, gotBody string
+	apiserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotPath = req.URL.Path
+		gotAuth = req.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(req.Body)
+		gotBody = string(body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer apiserver.Close()
+
+	config := &rest.Config{Host: apiserver.URL + "/prefix", BearerToken: "proxy-token"}
+	// stands for the policy transport registered by pidalio.New.
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Body = ioutil.NopCloser(strings.NewReader("mutated"))
+			req.ContentLength = int64(len("mutated"))
+			return rt.RoundTrip(req)
+		})
+	})
+
+	filter, err := newProxyFilter(defaultAcceptHosts, defaultRejectPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := newProxyHandler(config, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://localhost:8001/api/v1/namespaces/default/pods", strings.NewReader("{}"))
+	req.Header.Set("Authorization", "Bearer client-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusCreated)
+	}
+	if gotPath != "/prefix/api/v1/namespaces/default/pods" {
+		t.Errorf("path = %s", gotPath)
+	}
+	if gotAuth != "Bearer proxy-token" {
+		t.Errorf("authorization = %s, want the credentials of the proxy", gotAuth)
+	}
+	if gotBody != "mutated" {
+		t.Errorf("body = %s, want it sent through the wrapped transport", gotBody)
+	}
+}
+
+func TestProxyFilter(t *testing.T) {
+	filter, err := newProxyFilter(defaultAcceptHosts, defaultRejectPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		want bool
+	}{
+		{name: "localhost", host: "localhost:8001", path: "/api/v1/pods", want: true},
+		{name: "ipv4 loopback", host: "127.0.0.1:8001", path: "/api/v1/pods", want: true},
+		{name: "ipv6 loopback", host: "[::1]:8001", path: "/api/v1/pods", want: true},
+		{name: "host without port", host: "localhost", path: "/api/v1/pods", want: true},
+		{name: "rebound host", host: "attacker.example.com:8001", path: "/api/v1/pods"},
+		{name: "exec", host: "localhost:8001", path: "/api/v1/namespaces/default/pods/p/exec"},
+		{name: "attach", host: "localhost:8001", path: "/api/v1/namespaces/default/pods/p/attach"},
+		{name: "portforward", host: "localhost:8001", path: "/api/v1/namespaces/default/pods/p/portforward"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			req.Host = tt.host
+			if got := filter.accepts(req); got != tt.want {
+				t.Errorf("accepts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err = newProxyFilter("[", ""); err == nil {
+		t.Error("newProxyFilter() error = nil, want error for an invalid regular expression")
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		address          string
+		allowNonLoopback bool
+		wantErr          bool
+	}{
+		{address: "127.0.0.1"},
+		{address: "::1"},
+		{address: "localhost"},
+		{address: "0.0.0.0", wantErr: true},
+		{address: "", wantErr: true},
+		{address: "192.168.1.1", wantErr: true},
+		{address: "0.0.0.0", allowNonLoopback: true},
+	}
+	for _, tt := range tests {
+		if err := checkAddress(tt.address, tt.allowNonLoopback); (err != nil) != tt.wantErr {
+			t.Errorf("checkAddress(%q, %v) error = %v, wantErr %v", tt.address, tt.allowNonLoopback, err, tt.wantErr)
+		}
+	}
+}
+
+func TestProxyKubeconfig(t *testing.T) {
+	data, err := proxyKubeconfig("http://127.0.0.1:8001")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "http://127.0.0.1:8001" {
+		t.Errorf("host = %s", config.Host)
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+
+	"github.com/k-cloud-labs/pidalio"
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+)
+
+const (
+	colorReset = "\033[0m"
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorCyan  = "\033[36m"
+)
+
+func runExplain(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	var (
+		filename    string
+		kubeconfig  string
+		policies    string
+		operation   string
+		noColor     bool
+		syncTimeout time.Duration
+	)
+	fs.StringVar(&filename, "f", "", "The manifest to explain, - reads from stdin.")
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "Path to the kubeconfig, the default loading rules of kubectl apply if empty.")
+	fs.StringVar(&policies, "policies", "", "Comma separated policy files or directories to use instead of the policies in the cluster.")
+	fs.StringVar(&operation, "operation", string(admissionv1.Create), "The operation to explain, CREATE or UPDATE.")
+	fs.BoolVar(&noColor, "no-color", false, "Print the diff without colors.")
+	fs.DurationVar(&syncTimeout, "sync-timeout", time.Minute, "The max duration to wait for policies to be synced.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(filename) == 0 {
+		return fmt.Errorf("-f is required")
+	}
+
+	objs, err := readManifest(filename)
+	if err != nil {
+		return err
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		// policies loaded from files are explained without a cluster.
+		if len(policies) == 0 || !clientcmd.IsEmptyConfig(err) {
+			return err
+		}
+		config = &rest.Config{}
+	}
+
+	opts := pidalio.Options{SyncTimeout: syncTimeout}
+	if len(policies) != 0 {
+		if opts.PolicySource, err = lister.NewFilePolicySource(strings.Split(policies, ",")...); err != nil {
+			return err
+		}
+	}
+
+	t, err := pidalio.New(config, opts)
+	if err != nil {
+		return err
+	}
+	defer t.Stop()
+
+	ctx := context.Background()
+	if err = t.Start(ctx); err != nil {
+		return err
+	}
+	if err = t.WaitForSync(ctx); err != nil {
+		return err
+	}
+
+	p := &explainPrinter{out: out, color: !noColor}
+	for _, obj := range objs {
+		explanation, err := t.Explain(ctx, obj, admissionv1.Operation(strings.ToUpper(operation)))
+		if err != nil {
+			return fmt.Errorf("failed to explain %s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		if err = p.print(explanation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readManifest reads all the objects in a yaml or json manifest.
+func readManifest(filename string) ([]*unstructured.Unstructured, error) {
+	var r io.Reader = os.Stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var objs []*unstructured.Unstructured
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				return objs, nil
+			}
+			return nil, err
+		}
+		if len(obj.Object) != 0 {
+			objs = append(objs, obj)
+		}
+	}
+}
+
+type explainPrinter struct {
+	out   io.Writer
+	color bool
+}
+
+func (p *explainPrinter) print(explanation *pidalio.Explanation) error {
+	obj := explanation.Original
+	name := obj.GetName()
+	if len(obj.GetNamespace()) != 0 {
+		name = obj.GetNamespace() + "/" + name
+	}
+	p.printf(colorCyan, "# %s %s\n", obj.GetKind(), name)
+
+	if len(explanation.Excluded) != 0 {
+		p.printf("", "excluded by %s.\n\n", explanation.Excluded)
+		return nil
+	}
+
+	if len(explanation.TemplatePatch) != 0 {
+		p.printf("", "templates rendered:\n")
+		if err := p.printJSON(explanation.TemplatePatch); err != nil {
+			return err
+		}
+	}
+
+	if len(explanation.Policies) == 0 && len(explanation.TemplatePatch) == 0 {
+		p.printf("", "no policy applied.\n\n")
+		return nil
+	}
+
+	for i, policy := range explanation.Policies {
+		name := policy.Name
+		if len(policy.Namespace) != 0 {
+			name = policy.Namespace + "/" + name
+		}
+		p.printf(colorCyan, "## %d. %s %s\n", i+1, policy.Kind, name)
+		if err := p.printJSON(policy.Patch); err != nil {
+			return err
+		}
+		for _, cue := range policy.RenderedCue {
+			p.printf("", "rendered cue:\n%s\n", cue)
+		}
+	}
+
+	original, err := yaml.Marshal(explanation.Original.Object)
+	if err != nil {
+		return err
+	}
+	mutated, err := yaml.Marshal(explanation.Object.Object)
+	if err != nil {
+		return err
+	}
+
+	p.printf(colorCyan, "## diff\n")
+	for _, line := range diffLines(splitLines(string(original)), splitLines(string(mutated))) {
+		switch line[0] {
+		case '-':
+			p.printf(colorRed, "%s\n", line)
+		case '+':
+			p.printf(colorGreen, "%s\n", line)
+		default:
+			p.printf("", "%s\n", line)
+		}
+	}
+	p.printf("", "\n")
+
+	return nil
+}
+
+func (p *explainPrinter) printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	p.printf("", "%s\n", data)
+	return nil
+}
+
+func (p *explainPrinter) printf(color, format string, args ...interface{}) {
+	if p.color && len(color) != 0 {
+		format = color + strings.TrimSuffix(format, "\n") + colorReset + "\n"
+	}
+	fmt.Fprintf(p.out, format, args...)
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the lines of a and b prefixed by "-" if only in a, "+" if only in b and " " if in both.
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+
+	return lines
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/k-cloud-labs/pidalio"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []string
+		want []string
+	}{
+		{
+			name: "equal",
+			a:    []string{"a", "b"},
+			b:    []string{"a", "b"},
+			want: []string{" a", " b"},
+		},
+		{
+			name: "changed line",
+			a:    []string{"a", "b", "c"},
+			b:    []string{"a", "x", "c"},
+			want: []string{" a", "-b", "+x", " c"},
+		},
+		{
+			name: "added lines",
+			a:    []string{"a"},
+			b:    []string{"a", "b", "c"},
+			want: []string{" a", "+b", "+c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplainPrinter_print(t *testing.T) {
+	original := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "cm", "namespace": "default"},
+	}}
+	mutated := original.DeepCopy()
+	mutated.SetLabels(map[string]string{"app": "web"})
+
+	out := &bytes.Buffer{}
+	p := &explainPrinter{out: out}
+	err := p.print(&pidalio.Explanation{
+		Original: original,
+		Object:   mutated,
+		Policies: []pidalio.PolicyExplanation{
+			{
+				Kind: "ClusterOverridePolicy",
+				Name: "add-label",
+				Patch: []jsonpatchv2.JsonPatchOperation{
+					{Operation: "add", Path: "/metadata/labels", Value: map[string]interface{}{"app": "web"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"# ConfigMap default/cm", "## 1. ClusterOverridePolicy add-label", `"path": "/metadata/labels"`, "+  labels:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("print() = %s, want it to contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestRunExplain_WithoutCluster(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("KUBECONFIG", filepath.Join(dir, "missing"))
+	t.Setenv("HOME", dir)
+
+	manifest := filepath.Join(dir, "cm.yaml")
+	if err := os.WriteFile(manifest, []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n  namespace: default\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	policies := filepath.Join(dir, "policies")
+	if err := os.Mkdir(policies, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := runExplain([]string{"-f", manifest, "--policies", policies, "--no-color"}, out); err != nil {
+		t.Fatalf("runExplain() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "# ConfigMap default/cm") {
+		t.Errorf("runExplain() output = %q, want the explained ConfigMap", out.String())
+	}
+}
@@ -0,0 +1,40 @@
+// pidalio is the command line tool of pidalio.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `pidalio is the command line tool of pidalio.
+
+Usage:
+  pidalio explain -f manifest.yaml    Explain how policies mutate the objects in a manifest.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "explain":
+		err = runExplain(os.Args[2:], os.Stdout)
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		os.Exit(1)
+	}
+}
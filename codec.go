@@ -0,0 +1,119 @@
+package pidalio
+
+import (
+	"bytes"
+	"mime"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"sigs.k8s.io/yaml"
+)
+
+// bodyCodec decodes a request body to an unstructured object and encodes it back in the same content type.
+type bodyCodec interface {
+	decode(body []byte) (*unstructured.Unstructured, error)
+	encode(obj *unstructured.Unstructured) ([]byte, error)
+}
+
+var (
+	_ bodyCodec = jsonCodec{}
+	_ bodyCodec = yamlCodec{}
+	_ bodyCodec = protobufCodec{}
+)
+
+// codecForContentType returns the codec for a request body with the given Content-Type.
+// The second return value is false if the content type is not supported.
+func codecForContentType(contentType string) (bodyCodec, bool) {
+	if len(contentType) == 0 {
+		return jsonCodec{}, true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	switch mediaType {
+	case runtime.ContentTypeJSON:
+		return jsonCodec{}, true
+	case runtime.ContentTypeYAML:
+		return yamlCodec{}, true
+	case runtime.ContentTypeProtobuf:
+		return protobufCodec{serializer: protobuf.NewSerializer(aggregatedScheme, aggregatedScheme)}, true
+	default:
+		return nil, false
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) decode(body []byte) (*unstructured.Unstructured, error) {
+	return bytesToUnstructured(body)
+}
+
+func (jsonCodec) encode(obj *unstructured.Unstructured) ([]byte, error) {
+	return obj.MarshalJSON()
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) decode(body []byte) (*unstructured.Unstructured, error) {
+	jsonBytes, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytesToUnstructured(jsonBytes)
+}
+
+func (yamlCodec) encode(obj *unstructured.Unstructured) ([]byte, error) {
+	jsonBytes, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.JSONToYAML(jsonBytes)
+}
+
+// protobufCodec converts protobuf bodies of types registered in aggregatedScheme.
+type protobufCodec struct {
+	serializer *protobuf.Serializer
+}
+
+func (c protobufCodec) decode(body []byte) (*unstructured.Unstructured, error) {
+	obj, gvk, err := c.serializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	unstructuredObj := &unstructured.Unstructured{Object: content}
+	unstructuredObj.SetGroupVersionKind(*gvk)
+
+	return unstructuredObj, nil
+}
+
+func (c protobufCodec) encode(obj *unstructured.Unstructured) ([]byte, error) {
+	gvk := obj.GroupVersionKind()
+	typed, err := aggregatedScheme.New(gvk)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, typed); err != nil {
+		return nil, err
+	}
+	typed.GetObjectKind().SetGroupVersionKind(gvk)
+
+	buf := &bytes.Buffer{}
+	if err = c.serializer.Encode(typed, buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,96 @@
+package pidalio
+
+import (
+	"bytes"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+)
+
+func Test_codecForContentType(t *testing.T) {
+	pod := &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: metav1.NamespaceDefault, Name: "web-1"},
+	}
+	protobufBody := &bytes.Buffer{}
+	if err := protobuf.NewSerializer(aggregatedScheme, aggregatedScheme).Encode(pod, protobufBody); err != nil {
+		t.Fatalf("failed to encode pod: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantOK      bool
+		wantErr     bool
+	}{
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        []byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"web-1","namespace":"default"}}`),
+			wantOK:      true,
+		},
+		{
+			name:        "yaml",
+			contentType: runtime.ContentTypeYAML,
+			body:        []byte("apiVersion: v1\nkind: Pod\nmetadata:\n  name: web-1\n  namespace: default\n"),
+			wantOK:      true,
+		},
+		{
+			name:        "protobuf",
+			contentType: runtime.ContentTypeProtobuf,
+			body:        protobufBody.Bytes(),
+			wantOK:      true,
+		},
+		{
+			name:        "invalid protobuf",
+			contentType: runtime.ContentTypeProtobuf,
+			body:        []byte(`{"apiVersion":"v1","kind":"Pod"}`),
+			wantOK:      true,
+			wantErr:     true,
+		},
+		{
+			name:        "unsupported",
+			contentType: "text/plain",
+			wantOK:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codec, ok := codecForContentType(tt.contentType)
+			if ok != tt.wantOK {
+				t.Fatalf("codecForContentType() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			obj, err := codec.decode(tt.body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if obj.GetAPIVersion() != "v1" || obj.GetKind() != "Pod" || obj.GetName() != "web-1" {
+				t.Fatalf("decode() got %v", obj.Object)
+			}
+
+			obj.SetAnnotations(map[string]string{"foo": "bar"})
+			body, err := codec.encode(obj)
+			if err != nil {
+				t.Fatalf("encode() error = %v", err)
+			}
+			got, err := codec.decode(body)
+			if err != nil {
+				t.Fatalf("decode() encoded body error = %v", err)
+			}
+			if got.GetAnnotations()["foo"] != "bar" {
+				t.Errorf("encode() lost annotations, got %v", got.GetAnnotations())
+			}
+		})
+	}
+}
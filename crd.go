@@ -0,0 +1,202 @@
+package pidalio
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+// ErrPolicyCRDsMissing is returned by WaitForSync if the CRDs of the policies watched are not installed and
+// Options.AllowMissingCRDs is set. Requests are passed through untouched until they are installed.
+var ErrPolicyCRDsMissing = errors.New("policy CRDs are missing")
+
+// crdRecheckInterval is the interval the policy CRDs are discovered again at while they are missing, in case the
+// events of CRDs are missed or not permitted to watch.
+const crdRecheckInterval = 30 * time.Second
+
+var crdResource = apiextensionsv1.SchemeGroupVersion.WithResource("customresourcedefinitions")
+
+// crdWatcher waits for the CRDs of the policies watched to be served by the apiserver before watching policies.
+type crdWatcher struct {
+	discovery discovery.DiscoveryInterface
+	// informer watches CRDs to discover the policy resources again once their CRDs are changed. It is only run if
+	// listing and watching CRDs cluster-wide is permitted.
+	informer  cache.SharedIndexInformer
+	reviews   authorizationv1client.SelfSubjectAccessReviewInterface
+	resources []schema.GroupVersionResource
+	// missing is 1 while the CRDs are missing or the policies are syncing after they are installed.
+	missing int32
+	// installed is 1 once the CRDs are installed.
+	installed int32
+	changed   chan struct{}
+}
+
+// newCRDWatcher returns a watcher waiting for the CRDs of resources, which are policy resources. reviews checks
+// whether CRDs are permitted to watch.
+func newCRDWatcher(dc discovery.DiscoveryInterface, client dynamic.Interface,
+	reviews authorizationv1client.SelfSubjectAccessReviewInterface, resources []schema.GroupVersionResource) *crdWatcher {
+	w := &crdWatcher{
+		discovery: dc,
+		informer:  dynamicinformer.NewFilteredDynamicInformer(client, crdResource, "", 0, cache.Indexers{}, nil).Informer(),
+		reviews:   reviews,
+		resources: resources,
+		changed:   make(chan struct{}, 1),
+	}
+
+	names := sets.NewString()
+	for _, resource := range resources {
+		names.Insert(resource.GroupResource().String())
+	}
+	onChange := func(obj interface{}) {
+		if crd, ok := obj.(*unstructured.Unstructured); ok && names.Has(crd.GetName()) {
+			select {
+			case w.changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onChange,
+		UpdateFunc: func(_, newObj interface{}) {
+			onChange(newObj)
+		},
+	})
+
+	return w
+}
+
+// isMissing returns true while the policy CRDs are missing, requests are passed through then.
+func (w *crdWatcher) isMissing() bool {
+	return w != nil && atomic.LoadInt32(&w.missing) == 1
+}
+
+// waitingForCRDs returns true while the policy CRDs are not installed, the policies are syncing after.
+func (w *crdWatcher) waitingForCRDs() bool {
+	return w.isMissing() && atomic.LoadInt32(&w.installed) == 0
+}
+
+// missingResources returns the policy resources not served by the apiserver.
+func (w *crdWatcher) missingResources() ([]schema.GroupVersionResource, error) {
+	list, err := w.discovery.ServerResourcesForGroupVersion(policyv1alpha1.SchemeGroupVersion.String())
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	served := sets.NewString()
+	if list != nil {
+		for _, resource := range list.APIResources {
+			served.Insert(resource.Name)
+		}
+	}
+
+	var missing []schema.GroupVersionResource
+	for _, resource := range w.resources {
+		if !served.Has(resource.Resource) {
+			missing = append(missing, resource)
+		}
+	}
+	return missing, nil
+}
+
+// canWatchCRDs returns true if listing and watching CRDs is permitted.
+func (w *crdWatcher) canWatchCRDs(ctx context.Context) bool {
+	for _, verb := range []string{"list", "watch"} {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:     verb,
+					Group:    crdResource.Group,
+					Resource: crdResource.Resource,
+				},
+			},
+		}
+		review, err := w.reviews.Create(ctx, review, metav1.CreateOptions{})
+		if err != nil {
+			klog.ErrorS(err, "failed to review the access to CRDs.", "verb", verb)
+			return false
+		}
+		if !review.Status.Allowed {
+			klog.V(2).InfoS("CRDs are not permitted to watch.", "verb", verb, "reason", review.Status.Reason)
+			return false
+		}
+	}
+	return true
+}
+
+// start calls startSource if the policy CRDs are served. Otherwise, it passes requests through and calls
+// startSource once they are installed, until the policies are synced or ctx is done.
+func (w *crdWatcher) start(ctx context.Context, startSource func() error, synced cache.InformerSynced) error {
+	missing, err := w.missingResources()
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return startSource()
+	}
+
+	klog.InfoS("policy CRDs are missing, requests are passed through until they are installed.", "resources", missing)
+	atomic.StoreInt32(&w.missing, 1)
+	go w.run(ctx, startSource, synced)
+	return nil
+}
+
+func (w *crdWatcher) run(ctx context.Context, startSource func() error, synced cache.InformerSynced) {
+	// the CRD informer is stopped once the CRDs are installed. Without permission to watch CRDs, they are only
+	// discovered again periodically.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if w.canWatchCRDs(ctx) {
+		go w.informer.Run(ctx.Done())
+	} else {
+		klog.InfoS("CRDs are not watched, policy CRDs are discovered again periodically.", "interval", crdRecheckInterval)
+	}
+
+	ticker := time.NewTicker(crdRecheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.changed:
+		case <-ticker.C:
+		}
+
+		missing, err := w.missingResources()
+		if err != nil {
+			klog.ErrorS(err, "failed to discover policy CRDs.")
+			continue
+		}
+		if len(missing) != 0 {
+			klog.V(4).InfoS("policy CRDs are still missing.", "resources", missing)
+			continue
+		}
+
+		klog.InfoS("policy CRDs are installed, start watching policies.")
+		atomic.StoreInt32(&w.installed, 1)
+		if err = startSource(); err != nil {
+			klog.ErrorS(err, "failed to start watching policies.")
+			return
+		}
+		if cache.WaitForCacheSync(ctx.Done(), synced) {
+			atomic.StoreInt32(&w.missing, 0)
+		}
+		return
+	}
+}
@@ -0,0 +1,185 @@
+package pidalio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+// newReviewClient returns a client reviewing the access to CRDs, which denies the verbs in denied.
+func newReviewClient(denied ...string) *kubefake.Clientset {
+	client := kubefake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		review := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		for _, verb := range denied {
+			if review.Spec.ResourceAttributes.Verb == verb {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func TestCRDWatcher(t *testing.T) {
+	newCRD := func(resource schema.GroupVersionResource) *unstructured.Unstructured {
+		crd := &unstructured.Unstructured{}
+		crd.SetGroupVersionKind(crdResource.GroupVersion().WithKind("CustomResourceDefinition"))
+		crd.SetName(resource.GroupResource().String())
+		return crd
+	}
+	servedResources := []*metav1.APIResourceList{
+		{
+			GroupVersion: policyv1alpha1.SchemeGroupVersion.String(),
+			APIResources: []metav1.APIResource{{Name: opGVR.Resource}, {Name: copGVR.Resource}},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		served      []*metav1.APIResourceList
+		wantMissing bool
+	}{
+		{
+			name:   "crds installed",
+			served: servedResources,
+		},
+		{
+			name:        "crds missing",
+			wantMissing: true,
+		},
+		{
+			name: "crd partially installed",
+			served: []*metav1.APIResourceList{
+				{
+					GroupVersion: policyv1alpha1.SchemeGroupVersion.String(),
+					APIResources: []metav1.APIResource{{Name: copGVR.Resource}},
+				},
+			},
+			wantMissing: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{Resources: tt.served}}
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{crdResource: "CustomResourceDefinitionList"})
+			reviews := newReviewClient().AuthorizationV1().SelfSubjectAccessReviews()
+			w := newCRDWatcher(dc, client, reviews, []schema.GroupVersionResource{opGVR, copGVR})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var started int32
+			startSource := func() error {
+				atomic.AddInt32(&started, 1)
+				return nil
+			}
+			synced := func() bool { return true }
+			if err := w.start(ctx, startSource, synced); err != nil {
+				t.Fatalf("start() error = %v", err)
+			}
+			if got := w.isMissing(); got != tt.wantMissing {
+				t.Fatalf("isMissing() = %v, want %v", got, tt.wantMissing)
+			}
+			if !tt.wantMissing {
+				if atomic.LoadInt32(&started) != 1 {
+					t.Errorf("policies are not watched with crds installed")
+				}
+				return
+			}
+			if atomic.LoadInt32(&started) != 0 {
+				t.Fatalf("policies are watched with crds missing")
+			}
+
+			// the watcher discovers the policy resources again once their CRDs are created.
+			dc.Resources = servedResources
+			for _, resource := range []schema.GroupVersionResource{opGVR, copGVR} {
+				if _, err := client.Resource(crdResource).Create(ctx, newCRD(resource), metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+				return !w.isMissing(), nil
+			})
+			if err != nil {
+				t.Fatalf("crds are not discovered after they are installed: %v", err)
+			}
+			if atomic.LoadInt32(&started) != 1 {
+				t.Errorf("policies are watched %d times, want once", started)
+			}
+		})
+	}
+}
+
+func TestCRDWatcher_canWatchCRDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		denied []string
+		want   bool
+	}{
+		{
+			name: "permitted",
+			want: true,
+		},
+		{
+			name:   "list denied",
+			denied: []string{"list"},
+		},
+		{
+			name:   "watch denied",
+			denied: []string{"watch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &crdWatcher{reviews: newReviewClient(tt.denied...).AuthorizationV1().SelfSubjectAccessReviews()}
+			if got := w.canWatchCRDs(context.Background()); got != tt.want {
+				t.Errorf("canWatchCRDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyTransport_RoundTripMissingCRDs(t *testing.T) {
+	body := []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}`)
+
+	var sent []byte
+	delegate := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent, _ = ioutil.ReadAll(req.Body)
+		return newResponse(http.StatusCreated, sent), nil
+	})
+
+	// policies are not evaluated at all, the engine has no override manager.
+	engine := &policyEngine{crds: &crdWatcher{missing: 1}, initialized: 1}
+	req, err := http.NewRequest(http.MethodPost, "https://127.0.0.1:6443/api/v1/namespaces/default/configmaps", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if _, err = engine.Wrap(delegate).RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	if !bytes.Equal(sent, body) {
+		t.Errorf("sent %s, want %s", sent, body)
+	}
+}
@@ -0,0 +1,89 @@
+package pidalio
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+)
+
+// leaseElector elects the only process doing a job among the processes using the transport by a lease.
+type leaseElector struct {
+	// name of the election in logs.
+	name    string
+	lock    resourcelock.Interface
+	leading int32
+	// onStartedLeading is called when the process becomes the leader.
+	onStartedLeading func(ctx context.Context)
+}
+
+// newLeaseElector returns an elector by lease namespace/name, identity defaults to the hostname. client must not
+// send requests through the transport.
+func newLeaseElector(name string, client kubernetes.Interface, namespace, leaseName, identity string,
+	onStartedLeading func(ctx context.Context)) (*leaseElector, error) {
+	if len(identity) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		identity = hostname
+	}
+
+	return &leaseElector{
+		name: name,
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      leaseName,
+			},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		onStartedLeading: onStartedLeading,
+	}, nil
+}
+
+// run takes part in the election until ctx is done.
+func (e *leaseElector) run(ctx context.Context) {
+	for {
+		le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            e.lock,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			ReleaseOnCancel: true,
+			Name:            e.name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) {
+					klog.InfoS("started leading.", "election", e.name, "identity", e.lock.Identity())
+					atomic.StoreInt32(&e.leading, 1)
+					e.onStartedLeading(ctx)
+				},
+				OnStoppedLeading: func() {
+					klog.InfoS("stopped leading.", "election", e.name, "identity", e.lock.Identity())
+					atomic.StoreInt32(&e.leading, 0)
+				},
+			},
+		})
+		if err != nil {
+			klog.ErrorS(err, "failed to create leader elector.", "election", e.name)
+			return
+		}
+
+		le.Run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// isLeader returns true if this process holds the lease.
+func (e *leaseElector) isLeader() bool {
+	return e != nil && atomic.LoadInt32(&e.leading) == 1
+}
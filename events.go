@@ -0,0 +1,133 @@
+package pidalio
+
+import (
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// reasons of the events recorded by the transport.
+const (
+	ReasonPolicyApplied          = "PolicyApplied"
+	ReasonPolicyEvaluationFailed = "PolicyEvaluationFailed"
+)
+
+const defaultEventsComponent = "pidalio"
+
+// EventsOptions configures recording Kubernetes events: PolicyApplied on a policy when it mutates an object and
+// PolicyEvaluationFailed on the failing policies, or on the object if no single policy fails. Similar events are
+// aggregated and rate limited by the client-go event correlator, so events are not sent on every request.
+type EventsOptions struct {
+	// Enabled enables recording events, it is disabled by default.
+	Enabled bool
+	// Component is the source component of events, defaults to pidalio.
+	Component string
+}
+
+// policyEvents records the events of policies, it records nothing if it is nil.
+type policyEvents struct {
+	recorder  record.EventRecorder
+	copLister v1alpha1.ClusterOverridePolicyLister
+	opLister  v1alpha1.OverridePolicyLister
+}
+
+func (s *setupManager) setupEvents(opts EventsOptions) error {
+	if len(opts.Component) == 0 {
+		opts.Component = defaultEventsComponent
+	}
+
+	// events are not sent through the transport.
+	kubeClient, err := kubernetes.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	go func() {
+		<-s.ctx.Done()
+		broadcaster.Shutdown()
+	}()
+
+	s.events = &policyEvents{
+		recorder:  broadcaster.NewRecorder(aggregatedScheme, corev1.EventSource{Component: opts.Component}),
+		copLister: s.copLister,
+		opLister:  s.opLister,
+	}
+	return nil
+}
+
+// applied records PolicyApplied on the policies applied on obj, except the policies skipped.
+func (e *policyEvents) applied(obj *unstructured.Unstructured, operation admissionv1.Operation,
+	cops, ops *overridemanager.AppliedOverrides, skipped sets.String) {
+	if e == nil {
+		return
+	}
+
+	message := fmt.Sprintf("Policy applied on %s %s on %s", obj.GetKind(), objectName(obj), operation)
+	for _, policy := range appliedPolicies(cops) {
+		if skipped.Has(policy.name) {
+			continue
+		}
+		cop, err := e.copLister.Get(policy.name)
+		if err != nil {
+			klog.V(4).InfoS("failed to get applied policy.", "policy", policy.name, "err", err)
+			continue
+		}
+		e.recorder.Event(cop, corev1.EventTypeNormal, ReasonPolicyApplied, message)
+	}
+	for _, policy := range appliedPolicies(ops) {
+		if skipped.Has(obj.GetNamespace() + "/" + policy.name) {
+			continue
+		}
+		op, err := e.opLister.OverridePolicies(obj.GetNamespace()).Get(policy.name)
+		if err != nil {
+			klog.V(4).InfoS("failed to get applied policy.", "policy", policy.name, "err", err)
+			continue
+		}
+		e.recorder.Event(op, corev1.EventTypeNormal, ReasonPolicyApplied, message)
+	}
+}
+
+// failed records PolicyEvaluationFailed on the failing policies, or on obj if no single policy fails.
+func (e *policyEvents) failed(obj *unstructured.Unstructured, operation admissionv1.Operation, policies []runtime.Object, err error) {
+	if e == nil {
+		return
+	}
+
+	if len(policies) == 0 {
+		// events are named after the object, which is not known yet if it is generated.
+		if len(obj.GetName()) != 0 {
+			e.recorder.Eventf(obj, corev1.EventTypeWarning, ReasonPolicyEvaluationFailed, "Failed to evaluate policies on %s: %v", operation, err)
+		}
+		return
+	}
+
+	for _, policy := range policies {
+		e.recorder.Eventf(policy, corev1.EventTypeWarning, ReasonPolicyEvaluationFailed,
+			"Failed to evaluate policy on %s %s on %s: %v", obj.GetKind(), objectName(obj), operation, err)
+	}
+}
+
+// objectName returns namespace/name of obj, or its generate name if it is not named yet.
+func objectName(obj *unstructured.Unstructured) string {
+	name := obj.GetName()
+	if len(name) == 0 {
+		name = obj.GetGenerateName()
+	}
+	if len(obj.GetNamespace()) == 0 {
+		return name
+	}
+	return obj.GetNamespace() + "/" + name
+}
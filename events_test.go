@@ -0,0 +1,124 @@
+package pidalio
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestPolicyTransport_RoundTripEvents(t *testing.T) {
+	newSpec := func(overrider policyv1alpha1.PlaintextOverrider) policyv1alpha1.OverridePolicySpec {
+		return policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create},
+					Overriders:       policyv1alpha1.Overriders{Plaintext: []policyv1alpha1.PlaintextOverrider{overrider}},
+				},
+			},
+		}
+	}
+	addLabel := policyv1alpha1.PlaintextOverrider{Path: "/metadata/labels/spot", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"true"`)}}
+	removeMissing := policyv1alpha1.PlaintextOverrider{Path: "/metadata/labels/missing", Operator: "remove"}
+
+	tests := []struct {
+		name     string
+		policies []interface{}
+		body     string
+		events   bool
+		// wantEvents are the prefixes of the events recorded.
+		wantEvents []string
+	}{
+		{
+			name: "policies applied",
+			policies: []interface{}{
+				&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}, Spec: newSpec(addLabel)},
+				&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "default"}, Spec: newSpec(addLabel)},
+			},
+			body:   `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default","labels":{"app":"web"}}}`,
+			events: true,
+			wantEvents: []string{
+				"Normal PolicyApplied Policy applied on ConfigMap default/cm on CREATE",
+				"Normal PolicyApplied Policy applied on ConfigMap default/cm on CREATE",
+			},
+		},
+		{
+			name: "policy failed",
+			policies: []interface{}{
+				&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}, Spec: newSpec(addLabel)},
+				&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "broken"}, Spec: newSpec(removeMissing)},
+			},
+			body:   `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"generateName":"cm-","namespace":"default","labels":{"app":"web"}}}`,
+			events: true,
+			wantEvents: []string{
+				"Warning PolicyEvaluationFailed Failed to evaluate policy on ConfigMap default/cm- on CREATE: ",
+			},
+		},
+		{
+			name: "events disabled",
+			policies: []interface{}{
+				&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}, Spec: newSpec(addLabel)},
+			},
+			body: `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default","labels":{"app":"web"}}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := lister.NewMemoryPolicySource(tt.policies...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copLister := lister.NewClusterOverridePolicyLister(source)
+			opLister := lister.NewOverridePolicyLister(source)
+
+			recorder := record.NewFakeRecorder(10)
+			var events *policyEvents
+			if tt.events {
+				events = &policyEvents{recorder: recorder, copLister: copLister, opLister: opLister}
+			}
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					failurePolicy:     &failurePolicyResolver{defaultPolicy: Ignore, copLister: copLister, opLister: opLister},
+					events:            events,
+				},
+				delegate: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					return newResponse(http.StatusCreated, nil), nil
+				}),
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1/api/v1/namespaces/default/configmaps", bytes.NewBufferString(tt.body))
+			if _, err = tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			close(recorder.Events)
+			var got []string
+			for event := range recorder.Events {
+				got = append(got, event)
+			}
+			sort.Strings(got)
+			if len(got) != len(tt.wantEvents) {
+				t.Fatalf("events = %q, want %q", got, tt.wantEvents)
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.wantEvents[i]) {
+					t.Errorf("events = %q, want %q", got, tt.wantEvents)
+				}
+			}
+		})
+	}
+}
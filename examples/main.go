@@ -5,6 +5,7 @@ import (
 	"flag"
 	"math/rand"
 	"strconv"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -21,7 +22,18 @@ func main() {
 	config := ctrl.GetConfigOrDie()
 
 	// the black magic code
-	pidalio.RegisterPolicyTransport(config, make(chan struct{}))
+	t, err := pidalio.New(config, pidalio.Options{SyncTimeout: time.Minute})
+	if err != nil {
+		klog.Fatalf("setup transport failed with error=%v", err)
+	}
+	if err = t.Start(context.Background()); err != nil {
+		klog.Fatalf("start transport failed with error=%v", err)
+	}
+	defer t.Stop()
+
+	if err = t.WaitForSync(context.Background()); err != nil {
+		klog.Fatalf("sync policies failed with error=%v", err)
+	}
 
 	client := kubernetes.NewForConfigOrDie(config)
 
@@ -30,7 +42,7 @@ func main() {
 		pod.Annotations = make(map[string]string)
 	}
 	pod.Annotations["random"] = strconv.Itoa(rand.Int())
-	pod, err := client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
+	pod, err = client.CoreV1().Pods("default").Update(context.Background(), pod, metav1.UpdateOptions{})
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,76 @@
+package pidalio
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+// SkipOverridesAnnotation on an object with value "true" makes the transport send it untouched.
+const SkipOverridesAnnotation = "policy.kcloudlabs.io/skip-overrides"
+
+// defaultExcludedNamespaces are the namespaces excluded if ExclusionOptions.Namespaces is nil.
+var defaultExcludedNamespaces = []string{"kube-system"}
+
+// ExclusionOptions configures the objects sent untouched by the transport, besides the objects with annotation
+// SkipOverridesAnnotation. (Cluster)OverridePolicies are never excluded, so their templates are always rendered.
+// Exclusions skip overrides only, excluded objects are still validated by ClusterValidatePolicies.
+type ExclusionOptions struct {
+	// Namespaces are the namespaces whose objects are excluded, defaults to kube-system if nil.
+	// Set it to an empty slice to exclude no namespace.
+	Namespaces []string
+	// Kinds are the kinds of objects excluded. An empty Version matches any version.
+	Kinds []schema.GroupVersionKind
+}
+
+// exclusions decides the objects sent untouched.
+type exclusions struct {
+	namespaces sets.String
+	kinds      []schema.GroupVersionKind
+}
+
+func newExclusions(opts ExclusionOptions) *exclusions {
+	namespaces := opts.Namespaces
+	if namespaces == nil {
+		namespaces = defaultExcludedNamespaces
+	}
+
+	return &exclusions{
+		namespaces: sets.NewString(namespaces...),
+		kinds:      opts.Kinds,
+	}
+}
+
+// excluded returns the reason obj is sent untouched, or an empty string if it is not excluded.
+// namespace is the namespace of the request, which is used if obj leaves its namespace out.
+func (e *exclusions) excluded(obj *unstructured.Unstructured, namespace string) string {
+	gvk := obj.GroupVersionKind()
+	if gvk.Group == policyv1alpha1.SchemeGroupVersion.Group && (gvk.Kind == "OverridePolicy" || gvk.Kind == "ClusterOverridePolicy") {
+		return ""
+	}
+
+	if obj.GetAnnotations()[SkipOverridesAnnotation] == "true" {
+		return "annotation " + SkipOverridesAnnotation
+	}
+
+	if e == nil {
+		return ""
+	}
+
+	if len(obj.GetNamespace()) != 0 {
+		namespace = obj.GetNamespace()
+	}
+	if len(namespace) != 0 && e.namespaces.Has(namespace) {
+		return "excluded namespace " + namespace
+	}
+
+	for _, kind := range e.kinds {
+		if kind.Group == gvk.Group && kind.Kind == gvk.Kind && (len(kind.Version) == 0 || kind.Version == gvk.Version) {
+			return "excluded kind " + gvk.String()
+		}
+	}
+
+	return ""
+}
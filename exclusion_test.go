@@ -0,0 +1,223 @@
+package pidalio
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+)
+
+func TestPolicyTransport_exclusions(t *testing.T) {
+	defaultExclusions := newExclusions(ExclusionOptions{
+		Kinds: []schema.GroupVersionKind{{Group: "apps", Kind: "Deployment"}},
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		exclusions  *exclusions
+		wantApplied bool
+	}{
+		{
+			name:        "not excluded",
+			method:      http.MethodPost,
+			url:         "/api/v1/namespaces/default/configmaps",
+			body:        `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}`,
+			exclusions:  defaultExclusions,
+			wantApplied: true,
+		},
+		{
+			name:       "skip annotation",
+			method:     http.MethodPost,
+			url:        "/api/v1/namespaces/default/configmaps",
+			body:       `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default","annotations":{"policy.kcloudlabs.io/skip-overrides":"true"}}}`,
+			exclusions: defaultExclusions,
+		},
+		{
+			name:   "skip annotation without exclusions",
+			method: http.MethodPost,
+			url:    "/api/v1/namespaces/default/configmaps",
+			body:   `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default","annotations":{"policy.kcloudlabs.io/skip-overrides":"true"}}}`,
+		},
+		{
+			name:        "skip annotation not true",
+			method:      http.MethodPost,
+			url:         "/api/v1/namespaces/default/configmaps",
+			body:        `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default","annotations":{"policy.kcloudlabs.io/skip-overrides":"false"}}}`,
+			exclusions:  defaultExclusions,
+			wantApplied: true,
+		},
+		{
+			name:       "excluded namespace by default",
+			method:     http.MethodPost,
+			url:        "/api/v1/namespaces/kube-system/configmaps",
+			body:       `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm"}}`,
+			exclusions: defaultExclusions,
+		},
+		{
+			name:        "no excluded namespace",
+			method:      http.MethodPost,
+			url:         "/api/v1/namespaces/kube-system/configmaps",
+			body:        `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm"}}`,
+			exclusions:  newExclusions(ExclusionOptions{Namespaces: []string{}}),
+			wantApplied: true,
+		},
+		{
+			name:       "excluded kind of any version",
+			method:     http.MethodPost,
+			url:        "/apis/apps/v1/namespaces/default/deployments",
+			body:       `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"}}`,
+			exclusions: defaultExclusions,
+		},
+		{
+			name:        "excluded kind of another version",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			body:        `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"}}`,
+			exclusions:  newExclusions(ExclusionOptions{Kinds: []schema.GroupVersionKind{{Group: "apps", Version: "v1beta1", Kind: "Deployment"}}}),
+			wantApplied: true,
+		},
+		{
+			name:        "excluded by patched object",
+			method:      http.MethodPatch,
+			url:         "/api/v1/namespaces/default/configmaps/cm",
+			contentType: "application/merge-patch+json",
+			body:        `{"metadata":{"annotations":{"policy.kcloudlabs.io/skip-overrides":"true"}}}`,
+			exclusions:  defaultExclusions,
+		},
+		{
+			name:        "policies are never excluded",
+			method:      http.MethodPost,
+			url:         "/apis/policy.kcloudlabs.io/v1alpha1/namespaces/kube-system/overridepolicies",
+			body:        `{"apiVersion":"policy.kcloudlabs.io/v1alpha1","kind":"OverridePolicy","metadata":{"name":"op","annotations":{"policy.kcloudlabs.io/skip-overrides":"true"}}}`,
+			exclusions:  defaultExclusions,
+			wantApplied: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &oldObjectRecorder{}
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   recorder,
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					exclusions:        tt.exclusions,
+				},
+			}
+			var sent []byte
+			tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					return newResponse(http.StatusOK, []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}`)), nil
+				}
+				sent, _ = io.ReadAll(req.Body)
+				return newResponse(http.StatusOK, nil), nil
+			})
+
+			req, _ := http.NewRequest(tt.method, "https://127.0.0.1"+tt.url, bytes.NewBufferString(tt.body))
+			if len(tt.contentType) != 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if recorder.called != tt.wantApplied {
+				t.Errorf("ApplyOverridePolicies() called = %v, want %v", recorder.called, tt.wantApplied)
+			}
+			if !tt.wantApplied && string(sent) != tt.body {
+				t.Errorf("RoundTrip() sent %s, want body untouched %s", sent, tt.body)
+			}
+		})
+	}
+}
+
+func TestPolicyTransport_exclusionsValidated(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		wantCode    int
+	}{
+		{
+			name:     "created",
+			method:   http.MethodPost,
+			url:      "/api/v1/namespaces/kube-system/configmaps",
+			body:     `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","labels":{"app":"cm"}}}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "create denied",
+			method:   http.MethodPost,
+			url:      "/api/v1/namespaces/kube-system/configmaps",
+			body:     `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm"}}`,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:        "patch denied",
+			method:      http.MethodPatch,
+			url:         "/api/v1/namespaces/kube-system/configmaps/cm",
+			contentType: "application/merge-patch+json",
+			body:        `{"data":{"key":"value"}}`,
+			wantCode:    http.StatusForbidden,
+		},
+		{
+			name:        "apply denied",
+			method:      http.MethodPatch,
+			url:         "/api/v1/namespaces/kube-system/configmaps/cm",
+			contentType: "application/apply-patch+yaml",
+			body:        `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm"}}`,
+			wantCode:    http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &oldObjectRecorder{}
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   recorder,
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					validateManager:   fakeValidateManager{},
+					exclusions:        newExclusions(ExclusionOptions{}),
+				},
+			}
+			var sent []byte
+			tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					return newResponse(http.StatusOK, []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"kube-system"}}`)), nil
+				}
+				sent, _ = io.ReadAll(req.Body)
+				return newResponse(http.StatusOK, nil), nil
+			})
+
+			req, _ := http.NewRequest(tt.method, "https://127.0.0.1"+tt.url, bytes.NewBufferString(tt.body))
+			if len(tt.contentType) != 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("RoundTrip() status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if recorder.called {
+				t.Error("ApplyOverridePolicies() called for an excluded object")
+			}
+			if tt.wantCode == http.StatusOK && string(sent) != tt.body {
+				t.Errorf("RoundTrip() sent %s, want body untouched %s", sent, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package pidalio
+
+import (
+	"context"
+
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/dynamiclister"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// Explanation explains how policies mutate an object.
+type Explanation struct {
+	// Original is the object before mutation.
+	Original *unstructured.Unstructured
+	// Object is the object after mutation, as it would be sent to the apiserver.
+	Object *unstructured.Unstructured
+	// Policies are the policies and mutators applied on the object in order: mutators running before policies,
+	// ClusterOverridePolicies, OverridePolicies, then mutators running after policies.
+	Policies []PolicyExplanation
+	// TemplatePatch is the patch rendering the templates of the object if it is a policy itself.
+	// Override policies are not applied on policies.
+	TemplatePatch []jsonpatchv2.JsonPatchOperation
+	// Excluded is the reason the object is sent untouched, see SkipOverridesAnnotation and ExclusionOptions.
+	Excluded string
+}
+
+// PolicyExplanation explains how a single policy mutates an object.
+type PolicyExplanation struct {
+	// Kind is ClusterOverridePolicy, OverridePolicy or Mutator.
+	Kind      string
+	Namespace string
+	Name      string
+	// Patch is the json patch the policy applies on the object mutated by the policies before it.
+	Patch []jsonpatchv2.JsonPatchOperation
+	// RenderedCue is the CUE rendered from the templates of the rules applied.
+	RenderedCue []string
+}
+
+// explainer applies policies the same way as the transport, one by one to explain them.
+type explainer struct {
+	policyInterrupter interrupter.PolicyInterrupter
+	overrideManager   overridemanager.OverrideManager
+	drLister          dynamiclister.DynamicResourceLister
+	copLister         v1alpha1.ClusterOverridePolicyLister
+	opLister          v1alpha1.OverridePolicyLister
+	mutators          *mutatorRegistry
+	exclusions        *exclusions
+}
+
+// Explain returns how the synced policies mutate obj on operation, without sending anything to the apiserver.
+// Policies are scoped by ctx the same way as requests, see WithOnlyPolicies and WithPolicyLabels. The client is
+// identified by Options.ClientName and the user of the rest.Config, unless it is set by WithClientIdentity.
+func (t *Transport) Explain(ctx context.Context, obj *unstructured.Unstructured, operation admissionv1.Operation) (*Explanation, error) {
+	if scope := policyScopeFrom(ctx); scope == nil || scope.client == nil {
+		ctx = WithClientIdentity(ctx, ClientIdentity{ClientName: t.policy.clientName, Username: t.policy.username})
+	}
+
+	e := &explainer{
+		policyInterrupter: t.policy.policyInterrupter,
+		overrideManager:   t.policy.overrideManager,
+		drLister:          t.policy.drLister,
+		copLister:         t.policy.copLister,
+		opLister:          t.policy.opLister,
+		mutators:          t.policy.mutators,
+		exclusions:        t.policy.exclusions,
+	}
+	if scope := policyScopeFrom(ctx); t.policy.scoped(scope) {
+		e.overrideManager = t.policy.scopedOverrideManager(scope)
+		e.copLister = &scopedClusterOverridePolicyLister{lister: e.copLister, scope: scope}
+		e.opLister = &scopedOverridePolicyLister{lister: e.opLister, scope: scope}
+	}
+
+	return e.explain(ctx, obj, operation)
+}
+
+func (e *explainer) explain(ctx context.Context, obj *unstructured.Unstructured, operation admissionv1.Operation) (*Explanation, error) {
+	explanation := &Explanation{Original: obj.DeepCopy(), Object: obj.DeepCopy()}
+	if explanation.Excluded = e.exclusions.excluded(obj, ""); len(explanation.Excluded) != 0 {
+		return explanation, nil
+	}
+
+	patches, err := e.policyInterrupter.OnMutating(explanation.Object, nil, operation)
+	if err != nil {
+		return nil, err
+	}
+	if len(patches) > 0 {
+		explanation.TemplatePatch = patches
+		return explanation, applyJSONPatch(explanation.Object, patches)
+	}
+
+	info := explainRequestInfo(obj, operation)
+	before, err := e.mutators.mutate(ctx, nil, BeforePolicies, info, explanation.Object, nil)
+	if err != nil {
+		return nil, err
+	}
+	explanation.Policies = append(explanation.Policies, explainMutators(before)...)
+
+	// replay the applied policies one by one on the object mutated by mutators to find the patch of each one.
+	current := explanation.Object.DeepCopy()
+	cops, ops, err := e.overrideManager.ApplyOverridePolicies(explanation.Object, nil, operation)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := e.mutators.mutate(ctx, nil, AfterPolicies, info, explanation.Object, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := withMutators(before, cops, after)
+	if err != nil {
+		return nil, err
+	}
+	if err = setAppliedOverrides(explanation.Object, applied, ops); err != nil {
+		return nil, err
+	}
+
+	for _, applied := range appliedPolicies(cops) {
+		cop, err := e.copLister.Get(applied.name)
+		if err != nil {
+			return nil, err
+		}
+
+		policyExplanation, err := e.explainPolicy(ctx, current, operation, "ClusterOverridePolicy", cop.Namespace, cop.Name, cop, applied)
+		if err != nil {
+			return nil, err
+		}
+		explanation.Policies = append(explanation.Policies, *policyExplanation)
+	}
+	for _, applied := range appliedPolicies(ops) {
+		op, err := e.opLister.OverridePolicies(current.GetNamespace()).Get(applied.name)
+		if err != nil {
+			return nil, err
+		}
+
+		policyExplanation, err := e.explainPolicy(ctx, current, operation, "OverridePolicy", op.Namespace, op.Name, op, applied)
+		if err != nil {
+			return nil, err
+		}
+		explanation.Policies = append(explanation.Policies, *policyExplanation)
+	}
+	explanation.Policies = append(explanation.Policies, explainMutators(after)...)
+
+	return explanation, nil
+}
+
+// explainRequestInfo returns the request info passed to mutators when obj is explained.
+// Resource is left empty since it is not known without discovery.
+func explainRequestInfo(obj *unstructured.Unstructured, operation admissionv1.Operation) RequestInfo {
+	gvk := obj.GroupVersionKind()
+	info := RequestInfo{
+		IsResourceRequest: true,
+		Verb:              "create",
+		APIGroup:          gvk.Group,
+		APIVersion:        gvk.Version,
+		Namespace:         obj.GetNamespace(),
+	}
+	if operation == admissionv1.Update {
+		info.Verb = "update"
+		info.Name = obj.GetName()
+	}
+
+	return info
+}
+
+func explainMutators(applied []appliedMutator) []PolicyExplanation {
+	var explanations []PolicyExplanation
+	for _, m := range applied {
+		explanations = append(explanations, PolicyExplanation{Kind: "Mutator", Name: m.name, Patch: m.patch})
+	}
+
+	return explanations
+}
+
+// explainPolicy applies policy alone on current and returns the patch it produces, current is mutated in place.
+func (e *explainer) explainPolicy(ctx context.Context, current *unstructured.Unstructured, operation admissionv1.Operation,
+	kind, namespace, name string, policy interface{}, applied appliedPolicy) (*PolicyExplanation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	source, err := lister.NewMemoryPolicySource(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	before, err := current.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	manager := overridemanager.NewOverrideManager(e.drLister,
+		lister.NewClusterOverridePolicyLister(source), lister.NewOverridePolicyLister(source))
+	if _, _, err = manager.ApplyOverridePolicies(current, nil, operation); err != nil {
+		return nil, err
+	}
+
+	after, err := current.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := jsonpatchv2.CreatePatch(before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PolicyExplanation{
+		Kind:        kind,
+		Namespace:   namespace,
+		Name:        name,
+		Patch:       patch,
+		RenderedCue: applied.renderedCue,
+	}, nil
+}
+
+// appliedPolicy is a policy recorded in the applied overrides with the CUE rendered for its rules.
+type appliedPolicy struct {
+	name        string
+	renderedCue []string
+}
+
+// appliedPolicies returns the policies in the applied overrides in order. Every rule applied is recorded as an item,
+// so the items of the same policy are merged.
+func appliedPolicies(applied *overridemanager.AppliedOverrides) []appliedPolicy {
+	if applied == nil {
+		return nil
+	}
+
+	var policies []appliedPolicy
+	for _, item := range applied.AppliedItems {
+		if len(policies) == 0 || policies[len(policies)-1].name != item.PolicyName {
+			policies = append(policies, appliedPolicy{name: item.PolicyName})
+		}
+		if len(item.Overriders.RenderedCue) != 0 {
+			last := &policies[len(policies)-1]
+			last.renderedCue = append(last.renderedCue, item.Overriders.RenderedCue)
+		}
+	}
+
+	return policies
+}
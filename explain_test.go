@@ -0,0 +1,120 @@
+package pidalio
+
+import (
+	"context"
+	"testing"
+
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestExplainer_explain(t *testing.T) {
+	newSpec := func(path, value string) policyv1alpha1.OverridePolicySpec {
+		return policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{
+							{
+								Path:     path,
+								Operator: "replace",
+								Value:    apiextensionsv1.JSON{Raw: []byte(value)},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	source, err := lister.NewMemoryPolicySource(
+		// applied after cop-a even though it is created first.
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop-b"}, Spec: newSpec("/metadata/annotations/owner", `"b"`)},
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop-a"}, Spec: newSpec("/metadata/annotations/owner", `"a"`)},
+		&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "default"}, Spec: newSpec("/metadata/annotations/team", `"op"`)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copLister := lister.NewClusterOverridePolicyLister(source)
+	opLister := lister.NewOverridePolicyLister(source)
+	e := &explainer{
+		policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+		overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+		copLister:         copLister,
+		opLister:          opLister,
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName("web")
+	obj.SetAnnotations(map[string]string{"owner": "", "team": ""})
+
+	explanation, err := e.explain(context.Background(), obj, admissionv1.Create)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obj.GetAnnotations()["owner"] != "" {
+		t.Errorf("explain() mutated the given object")
+	}
+	if got := explanation.Original.GetAnnotations()["owner"]; got != "" {
+		t.Errorf("Original owner = %q, want empty", got)
+	}
+	if got := explanation.Object.GetAnnotations()["owner"]; got != "b" {
+		t.Errorf("Object owner = %q, want b", got)
+	}
+
+	want := []PolicyExplanation{
+		{Kind: "ClusterOverridePolicy", Name: "cop-a", Patch: []jsonpatchv2.JsonPatchOperation{
+			{Operation: "replace", Path: "/metadata/annotations/owner", Value: "a"},
+		}},
+		{Kind: "ClusterOverridePolicy", Name: "cop-b", Patch: []jsonpatchv2.JsonPatchOperation{
+			{Operation: "replace", Path: "/metadata/annotations/owner", Value: "b"},
+		}},
+		{Kind: "OverridePolicy", Namespace: "default", Name: "op", Patch: []jsonpatchv2.JsonPatchOperation{
+			{Operation: "replace", Path: "/metadata/annotations/team", Value: "op"},
+		}},
+	}
+	if len(explanation.Policies) != len(want) {
+		t.Fatalf("Policies = %+v, want %+v", explanation.Policies, want)
+	}
+	for i, got := range explanation.Policies {
+		if got.Kind != want[i].Kind || got.Namespace != want[i].Namespace || got.Name != want[i].Name {
+			t.Errorf("Policies[%d] = %s %s/%s, want %s %s/%s", i, got.Kind, got.Namespace, got.Name,
+				want[i].Kind, want[i].Namespace, want[i].Name)
+		}
+		if len(got.Patch) != 1 || got.Patch[0].Json() != want[i].Patch[0].Json() {
+			t.Errorf("Policies[%d].Patch = %v, want %v", i, got.Patch, want[i].Patch)
+		}
+	}
+}
+
+func TestAppliedPolicies(t *testing.T) {
+	applied := &overridemanager.AppliedOverrides{AppliedItems: []overridemanager.OverridePolicyShadow{
+		{PolicyName: "a", Overriders: policyv1alpha1.Overriders{RenderedCue: "cue-1"}},
+		{PolicyName: "a", Overriders: policyv1alpha1.Overriders{RenderedCue: "cue-2"}},
+		{PolicyName: "b"},
+	}}
+
+	got := appliedPolicies(applied)
+	if len(got) != 2 || got[0].name != "a" || len(got[0].renderedCue) != 2 || got[1].name != "b" || len(got[1].renderedCue) != 0 {
+		t.Errorf("appliedPolicies() = %+v", got)
+	}
+
+	if got = appliedPolicies(nil); got != nil {
+		t.Errorf("appliedPolicies(nil) = %+v, want nil", got)
+	}
+}
@@ -0,0 +1,205 @@
+package pidalio
+
+import (
+	"fmt"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/klog/v2"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/dynamiclister"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// FailurePolicyType specifies how errors evaluating policies are handled, like the failure policy of admission webhooks.
+type FailurePolicyType string
+
+const (
+	// Ignore means that an error evaluating policies is ignored and the original request is sent.
+	Ignore FailurePolicyType = "Ignore"
+	// Fail means that an error evaluating policies fails the request.
+	Fail FailurePolicyType = "Fail"
+)
+
+// FailurePolicyAnnotation overrides the failure policy for errors of a single (Cluster)OverridePolicy.
+const FailurePolicyAnnotation = "policy.kcloudlabs.io/failure-policy"
+
+const (
+	// failsAloneCacheSize is the maximum number of results of applying a single policy cached.
+	failsAloneCacheSize = 1024
+	// failsAloneCacheTTL is the time the result of applying a single policy is cached for.
+	failsAloneCacheTTL = time.Minute
+)
+
+// policyError is an error evaluating policies together with the failure policy it resolves to.
+type policyError struct {
+	err           error
+	failurePolicy FailurePolicyType
+}
+
+func (e *policyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *policyError) Unwrap() error {
+	return e.err
+}
+
+// newFailedCallingError returns the error the apiserver returns when calling an admission webhook fails.
+func newFailedCallingError(err error) *apierrors.StatusError {
+	return apierrors.NewInternalError(fmt.Errorf("failed calling %q: %v", admissionName, err))
+}
+
+// failurePolicyResolver resolves the failure policy when override policies fail to apply on an object.
+type failurePolicyResolver struct {
+	defaultPolicy FailurePolicyType
+	drLister      dynamiclister.DynamicResourceLister
+	copLister     v1alpha1.ClusterOverridePolicyLister
+	opLister      v1alpha1.OverridePolicyLister
+	// results caches whether a policy fails alone by failsAloneKey, so a broken policy is not evaluated again on
+	// every failed request. Nothing is cached if it is nil.
+	results *utilcache.LRUExpireCache
+}
+
+// failsAloneKey identifies the result of applying a policy on its own. Policies failing are usually broken for the
+// objects of a kind, so the result is shared by the objects of the same kind until the policy changes or it expires.
+type failsAloneKey struct {
+	uid        types.UID
+	namespace  string
+	name       string
+	generation int64
+	gvk        schema.GroupVersionKind
+	operation  admissionv1.Operation
+}
+
+// defaultFailurePolicy returns the failure policy for errors which are not caused by a single policy.
+func (r *failurePolicyResolver) defaultFailurePolicy() FailurePolicyType {
+	if r == nil {
+		return Fail
+	}
+
+	return r.defaultPolicy
+}
+
+// withScope returns a resolver resolving the failure policy of the policies in scope only.
+func (r *failurePolicyResolver) withScope(scope *policyScope) *failurePolicyResolver {
+	if r == nil || scope == nil {
+		return r
+	}
+
+	scoped := *r
+	scoped.copLister = &scopedClusterOverridePolicyLister{lister: r.copLister, scope: scope}
+	scoped.opLister = &scopedOverridePolicyLister{lister: r.opLister, scope: scope}
+	return &scoped
+}
+
+// resolve applies every policy on its own to find the policies failing on obj. It returns Ignore only if all of
+// them resolve to Ignore, and the default failure policy if no single policy fails. The policies failing are
+// returned too.
+func (r *failurePolicyResolver) resolve(obj, oldObj *unstructured.Unstructured, operation admissionv1.Operation) (FailurePolicyType, []runtime.Object) {
+	if r == nil {
+		return Fail, nil
+	}
+
+	cops, err := r.copLister.List(labels.Everything())
+	if err != nil {
+		return r.defaultPolicy, nil
+	}
+
+	var ops []*policyv1alpha1.OverridePolicy
+	if len(obj.GetNamespace()) != 0 {
+		if ops, err = r.opLister.OverridePolicies(obj.GetNamespace()).List(labels.Everything()); err != nil {
+			return r.defaultPolicy, nil
+		}
+	}
+
+	var (
+		failed          []runtime.Object
+		failurePolicies []FailurePolicyType
+	)
+	for _, cop := range cops {
+		if r.failsAlone(obj, oldObj, operation, cop) {
+			failed = append(failed, cop)
+			failurePolicies = append(failurePolicies, r.failurePolicyOf(cop.Annotations))
+		}
+	}
+	for _, op := range ops {
+		if r.failsAlone(obj, oldObj, operation, op) {
+			failed = append(failed, op)
+			failurePolicies = append(failurePolicies, r.failurePolicyOf(op.Annotations))
+		}
+	}
+
+	if len(failed) == 0 {
+		return r.defaultPolicy, nil
+	}
+	for _, fp := range failurePolicies {
+		if fp == Fail {
+			return Fail, failed
+		}
+	}
+
+	return Ignore, failed
+}
+
+// failurePolicyOf returns the failure policy of a policy with the given annotations.
+func (r *failurePolicyResolver) failurePolicyOf(annotations map[string]string) FailurePolicyType {
+	switch fp := FailurePolicyType(annotations[FailurePolicyAnnotation]); fp {
+	case Ignore, Fail:
+		return fp
+	default:
+		return r.defaultPolicy
+	}
+}
+
+// failsAlone returns true if policy, which is a ClusterOverridePolicy or an OverridePolicy, fails to apply on obj.
+// The result is cached, see failsAloneKey.
+func (r *failurePolicyResolver) failsAlone(obj, oldObj *unstructured.Unstructured, operation admissionv1.Operation, policy metav1.Object) bool {
+	if r.results == nil {
+		return r.applyAlone(obj, oldObj, operation, policy)
+	}
+
+	key := failsAloneKey{
+		uid:        policy.GetUID(),
+		namespace:  policy.GetNamespace(),
+		name:       policy.GetName(),
+		generation: policy.GetGeneration(),
+		gvk:        obj.GroupVersionKind(),
+		operation:  operation,
+	}
+	if fails, ok := r.results.Get(key); ok {
+		return fails.(bool)
+	}
+
+	fails := r.applyAlone(obj, oldObj, operation, policy)
+	r.results.Add(key, fails, failsAloneCacheTTL)
+	return fails
+}
+
+// applyAlone applies policy on obj on its own and returns true if it fails.
+func (r *failurePolicyResolver) applyAlone(obj, oldObj *unstructured.Unstructured, operation admissionv1.Operation, policy metav1.Object) bool {
+	source, err := lister.NewMemoryPolicySource(policy)
+	if err != nil {
+		return false
+	}
+
+	manager := overridemanager.NewOverrideManager(r.drLister,
+		lister.NewClusterOverridePolicyLister(source), lister.NewOverridePolicyLister(source))
+	if _, _, err = manager.ApplyOverridePolicies(obj.DeepCopy(), oldObj, operation); err != nil {
+		klog.V(4).InfoS("policy fails to apply.", "policy", klog.KObj(policy), "resource", klog.KObj(obj), "err", err)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,171 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+	"github.com/k-cloud-labs/pkg/utils/util"
+)
+
+func TestPolicyTransport_RoundTripFailurePolicy(t *testing.T) {
+	newBrokenPolicy := func(failurePolicy string) *policyv1alpha1.ClusterOverridePolicy {
+		cop := &policyv1alpha1.ClusterOverridePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "broken"},
+			Spec: policyv1alpha1.OverridePolicySpec{
+				OverrideRules: []policyv1alpha1.RuleWithOperation{
+					{
+						TargetOperations: []admissionv1.Operation{admissionv1.Create},
+						Overriders: policyv1alpha1.Overriders{
+							Plaintext: []policyv1alpha1.PlaintextOverrider{
+								{
+									Path:     "/metadata/labels/missing",
+									Operator: "remove",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		if len(failurePolicy) != 0 {
+			cop.Annotations = map[string]string{FailurePolicyAnnotation: failurePolicy}
+		}
+		return cop
+	}
+
+	body := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"}}`
+
+	tests := []struct {
+		name          string
+		defaultPolicy FailurePolicyType
+		policy        *policyv1alpha1.ClusterOverridePolicy
+		wantCode      int
+	}{
+		{
+			name:          "fail by default",
+			defaultPolicy: Fail,
+			policy:        newBrokenPolicy(""),
+			wantCode:      http.StatusInternalServerError,
+		},
+		{
+			name:          "ignore by default",
+			defaultPolicy: Ignore,
+			policy:        newBrokenPolicy(""),
+			wantCode:      http.StatusCreated,
+		},
+		{
+			name:          "ignore by policy annotation",
+			defaultPolicy: Fail,
+			policy:        newBrokenPolicy(string(Ignore)),
+			wantCode:      http.StatusCreated,
+		},
+		{
+			name:          "fail by policy annotation",
+			defaultPolicy: Ignore,
+			policy:        newBrokenPolicy(string(Fail)),
+			wantCode:      http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			copIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			opIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			policyObj, _ := util.ToUnstructured(tt.policy)
+			if err := copIndexer.Add(policyObj); err != nil {
+				t.Fatalf("failed to add policy: %v", err)
+			}
+			copLister := lister.NewUnstructuredClusterOverridePolicyLister(copIndexer)
+			opLister := lister.NewUnstructuredOverridePolicyLister(opIndexer)
+
+			var sent []byte
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					failurePolicy: &failurePolicyResolver{
+						defaultPolicy: tt.defaultPolicy,
+						copLister:     copLister,
+						opLister:      opLister,
+					},
+				},
+				delegate: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					sent, _ = ioutil.ReadAll(req.Body)
+					return newResponse(http.StatusCreated, nil), nil
+				}),
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1/apis/apps/v1/namespaces/default/deployments", bytes.NewBufferString(body))
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("RoundTrip() status code = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+
+			if tt.wantCode == http.StatusCreated {
+				if string(sent) != body {
+					t.Errorf("RoundTrip() sent %s, want the original body %s", sent, body)
+				}
+				return
+			}
+
+			status := metav1.Status{}
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			if err = json.Unmarshal(respBody, &status); err != nil || status.Reason != metav1.StatusReasonInternalError {
+				t.Errorf("RoundTrip() got status %s, want an internal error", respBody)
+			}
+		})
+	}
+}
+
+func TestFailurePolicyResolver_failsAloneCached(t *testing.T) {
+	broken := &policyv1alpha1.ClusterOverridePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "broken", UID: "uid", Generation: 1},
+		Spec: policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{{Path: "/metadata/labels/missing", Operator: "remove"}},
+					},
+				},
+			},
+		},
+	}
+	fixed := broken.DeepCopy()
+	fixed.Spec.OverrideRules = nil
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("apps/v1")
+	obj.SetKind("Deployment")
+	obj.SetNamespace("default")
+	obj.SetName("web")
+
+	r := &failurePolicyResolver{defaultPolicy: Fail, results: utilcache.NewLRUExpireCache(failsAloneCacheSize)}
+	if !r.failsAlone(obj, nil, admissionv1.Create, broken) {
+		t.Fatal("failsAlone() = false, want true for a broken policy")
+	}
+	// the policy is not evaluated again until it changes.
+	if !r.failsAlone(obj, nil, admissionv1.Create, fixed) {
+		t.Error("failsAlone() = false, want the cached result of the same generation")
+	}
+	fixed.Generation = 2
+	if r.failsAlone(obj, nil, admissionv1.Create, fixed) {
+		t.Error("failsAlone() = true, want the policy evaluated again once it changes")
+	}
+}
@@ -0,0 +1,252 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// applyOverridePoliciesOnce applies the override policies on an updated obj, except the policies already reflected
+// in it: the policies recorded by the applied overrides annotations of obj with the same overriders as they apply
+// now, whose plaintext overriders are reflected by the content of obj too, see reflectsOverriders. obj usually
+// carries the annotations and the changes of the policies if it is read from the apiserver, so applying them again
+// would, for example, append to an array again. A controller rebuilding the object may keep the annotations but
+// drop the changes, which are applied again then.
+//
+// It returns the applied overrides of all the policies applied, together with the names of the policies skipped.
+// Policies are skipped only if they are scoped by their listers, otherwise all of them are applied. The policies are
+// evaluated twice if only some of them are reflected: on a copy of obj to find out the reflected ones, then the
+// others on obj.
+func (e *policyEngine) applyOverridePoliciesOnce(manager overridemanager.OverrideManager, scope *policyScope,
+	obj, oldObj *unstructured.Unstructured, operation admissionv1.Operation) (*overridemanager.AppliedOverrides,
+	*overridemanager.AppliedOverrides, sets.String, error) {
+	previousCops := appliedOverridesOf(obj, utils.AppliedClusterOverrides)
+	previousOps := appliedOverridesOf(obj, utils.AppliedOverrides)
+
+	candidate := obj.DeepCopy()
+	cops, ops, err := manager.ApplyOverridePolicies(candidate, oldObj, operation)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reflected := sets.NewString()
+	for name, overriders := range overridersByPolicy(cops) {
+		if previous, ok := previousCops[name]; ok && reflect.DeepEqual(previous, overriders) && reflectsOverriders(obj, overriders) {
+			reflected.Insert(name)
+		}
+	}
+	for name, overriders := range overridersByPolicy(ops) {
+		if previous, ok := previousOps[name]; ok && reflect.DeepEqual(previous, overriders) && reflectsOverriders(obj, overriders) {
+			reflected.Insert(obj.GetNamespace() + "/" + name)
+		}
+	}
+
+	switch {
+	case reflected.Len() == 0:
+		obj.Object = candidate.Object
+	case reflected.Len() == len(overridersByPolicy(cops))+len(overridersByPolicy(ops)):
+		klog.V(4).InfoS("all override policies are already reflected in the object.", "resource", klog.KObj(obj))
+	case e.copLister == nil || e.opLister == nil:
+		obj.Object = candidate.Object
+		reflected = sets.NewString()
+	default:
+		pending := scope.copy()
+		pending.reflected = reflected
+		if _, _, err = e.scopedOverrideManager(pending).ApplyOverridePolicies(obj, oldObj, operation); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return cops, ops, reflected, nil
+}
+
+// reflectsOverriders returns true if obj reflects every plaintext overrider: the value added or replaced is at its
+// path, or in the array at its path if it adds to an array, and the path removed is missing. The changes of the
+// other overriders, e.g. rendered by CUE, can not be told without evaluating them, they are assumed to be reflected.
+func reflectsOverriders(obj *unstructured.Unstructured, overriders []policyv1alpha1.Overriders) bool {
+	for _, o := range overriders {
+		for _, plaintext := range o.Plaintext {
+			if !reflectsPlaintext(obj.Object, plaintext) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func reflectsPlaintext(obj map[string]interface{}, overrider policyv1alpha1.PlaintextOverrider) bool {
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(overrider.Path, "/"), "/") {
+		segments = append(segments, strings.NewReplacer("~1", "/", "~0", "~").Replace(segment))
+	}
+
+	var value interface{}
+	if overrider.Operator != "remove" {
+		if err := json.Unmarshal(overrider.Value.Raw, &value); err != nil {
+			return false
+		}
+	}
+
+	// an element of an array may be moved since it is added, it is looked up in the whole array. An element removed
+	// by index can not be told apart from the others.
+	if parent, ok := lookupJSONPointer(obj, segments[:len(segments)-1]); ok {
+		if elements, isArray := parent.([]interface{}); isArray {
+			if overrider.Operator == "remove" {
+				return true
+			}
+			for _, element := range elements {
+				if jsonEqual(element, value) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	current, found := lookupJSONPointer(obj, segments)
+	switch overrider.Operator {
+	case "remove":
+		return !found
+	case "add", "replace":
+		return found && jsonEqual(current, value)
+	default:
+		return true
+	}
+}
+
+// lookupJSONPointer returns the value at the unescaped segments of a json pointer in obj.
+func lookupJSONPointer(obj interface{}, segments []string) (interface{}, bool) {
+	current := obj
+	for _, segment := range segments {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			next, ok := c[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			current = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// jsonEqual returns true if a and b are encoded to the same json, so numbers of different types are compared.
+func jsonEqual(a, b interface{}) bool {
+	aBytes, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bBytes, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aBytes, bBytes)
+}
+
+// appliedOverridesOf returns the overriders of every policy recorded by the applied overrides annotation of obj.
+func appliedOverridesOf(obj *unstructured.Unstructured, annotation string) map[string][]policyv1alpha1.Overriders {
+	value, ok := obj.GetAnnotations()[annotation]
+	if !ok {
+		return nil
+	}
+
+	var items []overridemanager.OverridePolicyShadow
+	if err := json.Unmarshal([]byte(value), &items); err != nil {
+		klog.V(4).InfoS("invalid applied overrides annotation.", "resource", klog.KObj(obj), "annotation", annotation, "err", err)
+		return nil
+	}
+
+	return overridersByPolicy(&overridemanager.AppliedOverrides{AppliedItems: items})
+}
+
+// overridersByPolicy groups the overriders of the rules applied by policy name. Mutators are left out.
+func overridersByPolicy(applied *overridemanager.AppliedOverrides) map[string][]policyv1alpha1.Overriders {
+	overriders := map[string][]policyv1alpha1.Overriders{}
+	if applied == nil {
+		return overriders
+	}
+
+	for _, item := range applied.AppliedItems {
+		if strings.HasPrefix(item.PolicyName, mutatorRecordPrefix) {
+			continue
+		}
+		overriders[item.PolicyName] = append(overriders[item.PolicyName], item.Overriders)
+	}
+	return overriders
+}
+
+// warnNonIdempotentOverrides counts the plaintext overriders applied on update which change the object again
+// every time they are applied: add to an array and remove. Every overrider is warned about once only, since it
+// is applied on every update. Policies in skipped are not applied.
+func (e *policyEngine) warnNonIdempotentOverrides(obj *unstructured.Unstructured, cops, ops *overridemanager.AppliedOverrides, skipped sets.String) {
+	warn := func(policy string, overriders []policyv1alpha1.Overriders) {
+		for _, o := range overriders {
+			for _, plaintext := range o.Plaintext {
+				if !isNonIdempotent(plaintext) {
+					continue
+				}
+
+				label := ""
+				if e.policyMetrics {
+					label = policy
+				}
+				nonIdempotentOverrides.WithLabelValues(label, string(plaintext.Operator)).Inc()
+
+				key := policy + " " + string(plaintext.Operator) + " " + plaintext.Path
+				if _, warned := e.warnedOverriders.LoadOrStore(key, struct{}{}); warned {
+					continue
+				}
+				klog.Warningf("Policy %s applies non-idempotent %s on %s on update, e.g. to %s, it changes the object again if the object already reflects it. Enable IdempotentOverrides to skip it.",
+					policy, plaintext.Operator, plaintext.Path, klog.KObj(obj))
+			}
+		}
+	}
+
+	for name, overriders := range overridersByPolicy(cops) {
+		if !skipped.Has(name) {
+			warn(name, overriders)
+		}
+	}
+	for name, overriders := range overridersByPolicy(ops) {
+		if policy := obj.GetNamespace() + "/" + name; !skipped.Has(policy) {
+			warn(policy, overriders)
+		}
+	}
+}
+
+// isNonIdempotent returns true if applying overrider twice does not result in the same object: adding to an array
+// inserts the value again, and removing a removed path fails.
+func isNonIdempotent(overrider policyv1alpha1.PlaintextOverrider) bool {
+	switch overrider.Operator {
+	case "add":
+		last := overrider.Path[strings.LastIndex(overrider.Path, "/")+1:]
+		if last == "-" {
+			return true
+		}
+		_, err := strconv.Atoi(last)
+		return err == nil
+	case "remove":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,248 @@
+package pidalio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestPolicyTransport_RoundTripIdempotent(t *testing.T) {
+	newPolicy := func(name string, overrider policyv1alpha1.PlaintextOverrider) *policyv1alpha1.ClusterOverridePolicy {
+		return &policyv1alpha1.ClusterOverridePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: policyv1alpha1.OverridePolicySpec{
+				OverrideRules: []policyv1alpha1.RuleWithOperation{
+					{
+						TargetOperations: []admissionv1.Operation{admissionv1.Create, admissionv1.Update},
+						Overriders:       policyv1alpha1.Overriders{Plaintext: []policyv1alpha1.PlaintextOverrider{overrider}},
+					},
+				},
+			},
+		}
+	}
+	finalizer := newPolicy("finalizer", policyv1alpha1.PlaintextOverrider{
+		Path: "/metadata/finalizers/-", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"cleanup"`)},
+	})
+	label := newPolicy("label", policyv1alpha1.PlaintextOverrider{
+		Path: "/metadata/labels/spot", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"true"`)},
+	})
+
+	// created returns the object created with the given policies applied, as a controller reads it before update.
+	created := func(policies ...interface{}) *unstructured.Unstructured {
+		source, err := lister.NewMemoryPolicySource(policies...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("ConfigMap")
+		obj.SetNamespace("default")
+		obj.SetName("cm")
+		obj.SetLabels(map[string]string{"app": "web"})
+		obj.SetFinalizers([]string{})
+		manager := overridemanager.NewOverrideManager(nil,
+			lister.NewClusterOverridePolicyLister(source), lister.NewOverridePolicyLister(source))
+		if err = ApplyOverridePolicy(manager, obj, admissionv1.Create); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+
+	// rebuilt returns obj rebuilt by a controller which keeps the annotations but drops the overridden fields.
+	rebuilt := func(obj *unstructured.Unstructured) *unstructured.Unstructured {
+		obj.SetFinalizers([]string{})
+		obj.SetLabels(map[string]string{"app": "web"})
+		return obj
+	}
+
+	tests := []struct {
+		name           string
+		idempotent     bool
+		obj            *unstructured.Unstructured
+		wantFinalizers int
+		wantWarnings   float64
+	}{
+		{
+			name:           "applied again",
+			obj:            created(finalizer, label),
+			wantFinalizers: 2,
+			wantWarnings:   1,
+		},
+		{
+			name:           "all reflected",
+			idempotent:     true,
+			obj:            created(finalizer, label),
+			wantFinalizers: 1,
+		},
+		{
+			name:           "new policy applied only",
+			idempotent:     true,
+			obj:            created(label),
+			wantFinalizers: 1,
+			wantWarnings:   1,
+		},
+		{
+			name:           "lost overrides applied again",
+			idempotent:     true,
+			obj:            rebuilt(created(finalizer, label)),
+			wantFinalizers: 1,
+			wantWarnings:   1,
+		},
+		{
+			name:           "changed policy applied again",
+			idempotent:     true,
+			obj:            created(finalizer, newPolicy("label", policyv1alpha1.PlaintextOverrider{Path: "/metadata/labels/spot", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"false"`)}})),
+			wantFinalizers: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := lister.NewMemoryPolicySource(finalizer, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			copLister := lister.NewClusterOverridePolicyLister(source)
+			opLister := lister.NewOverridePolicyLister(source)
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:         1,
+					overrideManager:     overridemanager.NewOverrideManager(nil, copLister, opLister),
+					policyInterrupter:   interrupter.NewPolicyInterrupterManager(),
+					copLister:           copLister,
+					opLister:            opLister,
+					idempotentOverrides: tt.idempotent,
+					policyMetrics:       true,
+				},
+			}
+			var sent *unstructured.Unstructured
+			tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				if sent, err = bytesToUnstructured(body); err != nil {
+					t.Fatal(err)
+				}
+				return newResponse(http.StatusOK, body), nil
+			})
+
+			nonIdempotentOverrides.Reset()
+			body, err := tt.obj.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, _ := http.NewRequest(http.MethodPut, "https://127.0.0.1/api/v1/namespaces/default/configmaps/cm", bytes.NewBuffer(body))
+			if _, err = tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if got := len(sent.GetFinalizers()); got != tt.wantFinalizers {
+				t.Errorf("finalizers = %v, want %d", sent.GetFinalizers(), tt.wantFinalizers)
+			}
+			if sent.GetLabels()["spot"] != "true" {
+				t.Errorf("labels = %v, want label spot", sent.GetLabels())
+			}
+			if got := testutil.ToFloat64(nonIdempotentOverrides.WithLabelValues("finalizer", "add")); got != tt.wantWarnings {
+				t.Errorf("non idempotent overrides = %v, want %v", got, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestPolicyEngine_warnNonIdempotentOverrides(t *testing.T) {
+	cops := &overridemanager.AppliedOverrides{AppliedItems: []overridemanager.OverridePolicyShadow{
+		{
+			PolicyName: "finalizer",
+			Overriders: policyv1alpha1.Overriders{Plaintext: []policyv1alpha1.PlaintextOverrider{
+				{Path: "/metadata/finalizers/-", Operator: "add"},
+				{Path: "/metadata/labels/spot", Operator: "add"},
+			}},
+		},
+	}}
+	obj := &unstructured.Unstructured{}
+	obj.SetNamespace("default")
+	obj.SetName("cm")
+
+	nonIdempotentOverrides.Reset()
+	e := &policyEngine{}
+	for i := 0; i < 3; i++ {
+		e.warnNonIdempotentOverrides(obj, cops, nil, nil)
+	}
+
+	if got := testutil.ToFloat64(nonIdempotentOverrides.WithLabelValues("", "add")); got != 3 {
+		t.Errorf("non idempotent overrides = %v, want 3 without policy names", got)
+	}
+	warned := 0
+	e.warnedOverriders.Range(func(_, _ interface{}) bool {
+		warned++
+		return true
+	})
+	if warned != 1 {
+		t.Errorf("warned overriders = %d, want the non-idempotent overrider warned once", warned)
+	}
+}
+
+func TestReflectsPlaintext(t *testing.T) {
+	obj := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"example.com/owner": "pidalio"},
+			"finalizers":  []interface{}{"other", "cleanup"},
+		},
+		"spec": map[string]interface{}{"replicas": int64(2)},
+	}
+
+	tests := []struct {
+		name      string
+		overrider policyv1alpha1.PlaintextOverrider
+		want      bool
+	}{
+		{
+			name:      "value added",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/spec/replicas", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`2`)}},
+			want:      true,
+		},
+		{
+			name:      "value changed",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/spec/replicas", Operator: "replace", Value: apiextensionsv1.JSON{Raw: []byte(`3`)}},
+		},
+		{
+			name:      "escaped path",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/metadata/annotations/example.com~1owner", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"pidalio"`)}},
+			want:      true,
+		},
+		{
+			name:      "element added",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/metadata/finalizers/0", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"cleanup"`)}},
+			want:      true,
+		},
+		{
+			name:      "element missing",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/metadata/finalizers/-", Operator: "add", Value: apiextensionsv1.JSON{Raw: []byte(`"protect"`)}},
+		},
+		{
+			name:      "path removed",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/spec/paused", Operator: "remove"},
+			want:      true,
+		},
+		{
+			name:      "path not removed",
+			overrider: policyv1alpha1.PlaintextOverrider{Path: "/spec/replicas", Operator: "remove"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reflectsPlaintext(obj, tt.overrider); got != tt.want {
+				t.Errorf("reflectsPlaintext() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
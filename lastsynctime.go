@@ -0,0 +1,216 @@
+package pidalio
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/k-cloud-labs/pkg/client/clientset/versioned"
+)
+
+const (
+	lastSyncTimeAnno = "policy.kcloudlabs.io/last-sync-time"
+	// lastSyncGenerationAnno is the generation of the policy when it was stamped, policies are stamped again once
+	// their spec changes.
+	lastSyncGenerationAnno = "policy.kcloudlabs.io/last-sync-generation"
+
+	defaultLastSyncTimeLeaseNamespace = metav1.NamespaceDefault
+	defaultLastSyncTimeLeaseName      = "pidalio-last-sync-time"
+)
+
+// LastSyncTimeOptions configures stamping policies with the last sync time annotation when they are added or
+// their spec changes. Only the process holding the lease stamps policies, and only the policies which are not
+// stamped yet or whose spec changed since they were stamped. Stamps are not sent through the transport.
+type LastSyncTimeOptions struct {
+	// Enabled enables stamping policies, it is disabled by default.
+	Enabled bool
+	// LeaseNamespace is the namespace of the lease to elect the process stamping policies, defaults to default.
+	LeaseNamespace string
+	// LeaseName is the name of the lease to elect the process stamping policies, defaults to pidalio-last-sync-time.
+	LeaseName string
+	// Identity is the identity of this process in the election, defaults to the hostname.
+	Identity string
+}
+
+// lastSyncTimeElector elects the only process stamping policies by a lease.
+type lastSyncTimeElector struct {
+	*leaseElector
+	// client stamps policies, its requests are not mutated.
+	client versioned.Interface
+}
+
+func (s *setupManager) setupLastSyncTime(opts LastSyncTimeOptions) error {
+	if len(opts.LeaseNamespace) == 0 {
+		opts.LeaseNamespace = defaultLastSyncTimeLeaseNamespace
+	}
+	if len(opts.LeaseName) == 0 {
+		opts.LeaseName = defaultLastSyncTimeLeaseName
+	}
+
+	// leases and stamps are not sent through the transport.
+	kubeClient, err := kubernetes.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+	policyClient, err := versioned.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+	elector, err := newLeaseElector("pidalio-last-sync-time", kubeClient, opts.LeaseNamespace, opts.LeaseName,
+		opts.Identity, s.stampAllPolicies)
+	if err != nil {
+		return err
+	}
+
+	s.lastSyncTime = &lastSyncTimeElector{leaseElector: elector, client: policyClient}
+	return nil
+}
+
+// isLeader returns true if this process stamps policies.
+func (e *lastSyncTimeElector) isLeader() bool {
+	return e != nil && e.leaseElector.isLeader()
+}
+
+// needsLastSyncTime returns true if the policy is not stamped yet or its spec changed since it was stamped.
+func needsLastSyncTime(policy metav1.Object) bool {
+	annotations := policy.GetAnnotations()
+	if _, ok := annotations[lastSyncTimeAnno]; !ok {
+		return true
+	}
+	return annotations[lastSyncGenerationAnno] != strconv.FormatInt(policy.GetGeneration(), 10)
+}
+
+// stampAllPolicies stamps the policies known by the listers which need it, it is called when this process starts
+// leading.
+func (s *setupManager) stampAllPolicies(ctx context.Context) {
+	ops, err := s.opLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "failed to list override policies.")
+	}
+	for _, op := range ops {
+		if !needsLastSyncTime(op) {
+			continue
+		}
+		if err = s.stampOverridePolicy(ctx, op.Namespace, op.Name, op.ResourceVersion, op.Generation); err != nil {
+			klog.ErrorS(err, "failed to stamp override policy.", "policy", klog.KObj(op))
+		}
+	}
+
+	cops, err := s.copLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "failed to list cluster override policies.")
+	}
+	for _, cop := range cops {
+		if !needsLastSyncTime(cop) {
+			continue
+		}
+		if err = s.stampClusterOverridePolicy(ctx, cop.Name, cop.ResourceVersion, cop.Generation); err != nil {
+			klog.ErrorS(err, "failed to stamp cluster override policy.", "policy", klog.KObj(cop))
+		}
+	}
+}
+
+func (s *setupManager) onAddOverridePolicyPolicy(obj any) error {
+	return s.onUpdaterOverridePolicyPolicy(nil, obj)
+}
+
+// onUpdaterOverridePolicyPolicy stamps the policy if its spec changed, which bumps its generation.
+func (s *setupManager) onUpdaterOverridePolicyPolicy(_, newObj any) error {
+	u := newObj.(*unstructured.Unstructured)
+	if !s.lastSyncTime.isLeader() || !needsLastSyncTime(u) {
+		return nil
+	}
+
+	return s.stampOverridePolicy(s.ctx, u.GetNamespace(), u.GetName(), u.GetResourceVersion(), u.GetGeneration())
+}
+
+func (s *setupManager) onAddClusterOverridePolicy(obj any) error {
+	return s.onUpdateClusterOverridePolicy(nil, obj)
+}
+
+// onUpdateClusterOverridePolicy stamps the policy if its spec changed, which bumps its generation.
+func (s *setupManager) onUpdateClusterOverridePolicy(_, newObj any) error {
+	u := newObj.(*unstructured.Unstructured)
+	if !s.lastSyncTime.isLeader() || !needsLastSyncTime(u) {
+		return nil
+	}
+
+	return s.stampClusterOverridePolicy(s.ctx, u.GetName(), u.GetResourceVersion(), u.GetGeneration())
+}
+
+func (s *setupManager) stampOverridePolicy(ctx context.Context, namespace, name, resourceVersion string, generation int64) error {
+	client := s.lastSyncTime.client.PolicyV1alpha1().OverridePolicies(namespace)
+	return stampLastSyncTime(resourceVersion, generation,
+		func(patch []byte) error {
+			_, err := client.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		},
+		func() (string, int64, error) {
+			op, err := client.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return "", 0, err
+			}
+			return op.ResourceVersion, op.Generation, nil
+		})
+}
+
+func (s *setupManager) stampClusterOverridePolicy(ctx context.Context, name, resourceVersion string, generation int64) error {
+	client := s.lastSyncTime.client.PolicyV1alpha1().ClusterOverridePolicies()
+	return stampLastSyncTime(resourceVersion, generation,
+		func(patch []byte) error {
+			_, err := client.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+			return err
+		},
+		func() (string, int64, error) {
+			cop, err := client.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return "", 0, err
+			}
+			return cop.ResourceVersion, cop.Generation, nil
+		})
+}
+
+// stampLastSyncTime sends a merge patch setting lastSyncTimeAnno and lastSyncGenerationAnno. The patch is guarded by
+// resourceVersion so the recorded generation is never stale, and it is retried with the latest resourceVersion and
+// generation on conflict.
+func stampLastSyncTime(resourceVersion string, generation int64, patch func([]byte) error, latest func() (string, int64, error)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		data, err := lastSyncTimePatch(resourceVersion, generation, time.Now())
+		if err != nil {
+			return err
+		}
+
+		err = patch(data)
+		if apierrors.IsConflict(err) {
+			rv, g, getErr := latest()
+			if getErr != nil {
+				return getErr
+			}
+			resourceVersion, generation = rv, g
+		}
+
+		return err
+	})
+}
+
+func lastSyncTimePatch(resourceVersion string, generation int64, now time.Time) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+			"annotations": map[string]string{
+				lastSyncTimeAnno:       strconv.FormatInt(now.UnixNano(), 10),
+				lastSyncGenerationAnno: strconv.FormatInt(generation, 10),
+			},
+		},
+	})
+}
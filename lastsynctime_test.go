@@ -0,0 +1,140 @@
+package pidalio
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestStampLastSyncTime(t *testing.T) {
+	conflict := apierrors.NewConflict(schema.GroupResource{Resource: "clusteroverridepolicies"}, "cop", errors.New("modified"))
+
+	tests := []struct {
+		name             string
+		patchErrs        []error
+		wantErr          bool
+		wantVersions     []string
+		wantGenerations  []string
+		latestVersion    string
+		latestVersionErr error
+	}{
+		{
+			name:            "patched",
+			patchErrs:       []error{nil},
+			wantVersions:    []string{"1"},
+			wantGenerations: []string{"1"},
+		},
+		{
+			name:            "retry with latest resource version on conflict",
+			patchErrs:       []error{conflict, nil},
+			latestVersion:   "2",
+			wantVersions:    []string{"1", "2"},
+			wantGenerations: []string{"1", "2"},
+		},
+		{
+			name:             "failed to get latest resource version",
+			patchErrs:        []error{conflict},
+			latestVersionErr: errors.New("not found"),
+			wantErr:          true,
+			wantVersions:     []string{"1"},
+			wantGenerations:  []string{"1"},
+		},
+		{
+			name:            "not retried on other errors",
+			patchErrs:       []error{errors.New("forbidden")},
+			wantErr:         true,
+			wantVersions:    []string{"1"},
+			wantGenerations: []string{"1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var versions, generations []string
+			err := stampLastSyncTime("1", 1,
+				func(data []byte) error {
+					patch := map[string]map[string]interface{}{}
+					if err := json.Unmarshal(data, &patch); err != nil {
+						t.Fatal(err)
+					}
+					annotations := patch["metadata"]["annotations"].(map[string]interface{})
+					if _, ok := annotations[lastSyncTimeAnno]; !ok {
+						t.Errorf("patch %s does not set %s", data, lastSyncTimeAnno)
+					}
+					versions = append(versions, patch["metadata"]["resourceVersion"].(string))
+					generations = append(generations, annotations[lastSyncGenerationAnno].(string))
+					return tt.patchErrs[len(versions)-1]
+				},
+				func() (string, int64, error) {
+					return tt.latestVersion, 2, tt.latestVersionErr
+				})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("stampLastSyncTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(versions) != len(tt.wantVersions) {
+				t.Fatalf("stampLastSyncTime() patched %v, want %v", versions, tt.wantVersions)
+			}
+			for i := range versions {
+				if versions[i] != tt.wantVersions[i] || generations[i] != tt.wantGenerations[i] {
+					t.Errorf("stampLastSyncTime() patched versions %v generations %v, want %v %v",
+						versions, generations, tt.wantVersions, tt.wantGenerations)
+				}
+			}
+		})
+	}
+}
+
+func TestLastSyncTimeElector_isLeader(t *testing.T) {
+	var e *lastSyncTimeElector
+	if e.isLeader() {
+		t.Errorf("nil elector should not be the leader")
+	}
+
+	e = &lastSyncTimeElector{}
+	if e.isLeader() {
+		t.Errorf("elector should not be the leader before elected")
+	}
+}
+
+func TestNeedsLastSyncTime(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		generation  int64
+		want        bool
+	}{
+		{
+			name:       "not stamped",
+			generation: 1,
+			want:       true,
+		},
+		{
+			name:        "stamped",
+			annotations: map[string]string{lastSyncTimeAnno: "1", lastSyncGenerationAnno: "1"},
+			generation:  1,
+		},
+		{
+			name:        "spec changed since stamped",
+			annotations: map[string]string{lastSyncTimeAnno: "1", lastSyncGenerationAnno: "1"},
+			generation:  2,
+			want:        true,
+		},
+		{
+			name:        "stamped without generation",
+			annotations: map[string]string{lastSyncTimeAnno: "1"},
+			generation:  1,
+			want:        true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &metav1.ObjectMeta{Annotations: tt.annotations, Generation: tt.generation}
+			if got := needsLastSyncTime(policy); got != tt.want {
+				t.Errorf("needsLastSyncTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
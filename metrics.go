@@ -0,0 +1,139 @@
+package pidalio
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const metricsNamespace = "pidalio"
+
+// outcomes of a request sent through the transport.
+const (
+	outcomeMutated   = "mutated"
+	outcomeUnchanged = "unchanged"
+	outcomeSkipped   = "skipped"
+	outcomeError     = "error"
+)
+
+// stages of cue evaluation.
+const (
+	cueStageRender   = "render"
+	cueStageOverride = "override"
+)
+
+var (
+	policyErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_errors_total",
+		Help:      "Number of requests failed to evaluate policies, partitioned by resource, verb and the failure policy applied.",
+	}, []string{"resource", "verb", "failure_policy"})
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Number of write requests sent through the transport, partitioned by group, version, kind, operation and outcome(mutated, unchanged, skipped or error).",
+	}, []string{"group", "version", "kind", "operation", "outcome"})
+
+	mutationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutation_duration_seconds",
+		Help:      "Latency added to write requests by mutating them before they are sent to the apiserver, partitioned by group, version, kind, operation and outcome.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"group", "version", "kind", "operation", "outcome"})
+
+	policyApplied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_applied_total",
+		Help:      "Number of requests mutated by a policy or mutator, partitioned by group, version, kind, operation and policy. The policy is empty unless Options.PolicyMetrics is set.",
+	}, []string{"group", "version", "kind", "operation", "policy"})
+
+	cueEvaluationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "cue_evaluation_duration_seconds",
+		Help:      "Time evaluating policies, partitioned by stage: render for rendering the templates of policies to CUE, override for applying override policies including their CUE.",
+		Buckets:   []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+	}, []string{"stage"})
+
+	requestBodySize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_body_size_bytes",
+		Help:      "Size of the bodies of write requests received by the transport, partitioned by group, version, kind and operation.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"group", "version", "kind", "operation"})
+
+	nonIdempotentOverrides = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "non_idempotent_overrides_total",
+		Help:      "Number of non-idempotent plaintext overriders applied on update, which change the object again if it already reflects them, partitioned by policy and operator. The policy is empty unless Options.PolicyMetrics is set.",
+	}, []string{"policy", "operator"})
+
+	collectors = []prometheus.Collector{
+		policyErrors,
+		requestsTotal,
+		mutationDuration,
+		policyApplied,
+		cueEvaluationDuration,
+		requestBodySize,
+		nonIdempotentOverrides,
+	}
+)
+
+// RegisterMetrics registers the metrics of the transport to registerer, e.g. the
+// controller-runtime metrics.Registry served by the metrics server of a manager.
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mutationRecord collects what happens to a write request to report metrics.
+type mutationRecord struct {
+	// gvk is the kind of the object written, it is empty if the body is not decoded.
+	gvk     schema.GroupVersionKind
+	outcome string
+	// policies are the policies and mutators which mutated the object.
+	policies []string
+	// patchCount is the number of json patch operations applied, it is only counted when tracing.
+	patchCount int
+}
+
+func newMutationRecord(info *RequestInfo) *mutationRecord {
+	return &mutationRecord{
+		gvk:     schema.GroupVersionKind{Group: info.APIGroup, Version: info.APIVersion},
+		outcome: outcomeSkipped,
+	}
+}
+
+// observe reports the metrics of a request, the names of policies are only reported if policyNames is true.
+func (r *mutationRecord) observe(info *RequestInfo, duration time.Duration, bodySize int, policyNames bool) {
+	requestsTotal.WithLabelValues(r.gvk.Group, r.gvk.Version, r.gvk.Kind, info.Verb, r.outcome).Inc()
+	mutationDuration.WithLabelValues(r.gvk.Group, r.gvk.Version, r.gvk.Kind, info.Verb, r.outcome).Observe(duration.Seconds())
+	requestBodySize.WithLabelValues(r.gvk.Group, r.gvk.Version, r.gvk.Kind, info.Verb).Observe(float64(bodySize))
+	for _, policy := range r.policies {
+		if !policyNames {
+			policy = ""
+		}
+		policyApplied.WithLabelValues(r.gvk.Group, r.gvk.Version, r.gvk.Kind, info.Verb, policy).Inc()
+	}
+}
+
+// annotate sets what happened to the request as attributes of span.
+func (r *mutationRecord) annotate(span Span) {
+	span.SetAttribute(attrGroup, r.gvk.Group)
+	span.SetAttribute(attrVersion, r.gvk.Version)
+	span.SetAttribute(attrKind, r.gvk.Kind)
+	span.SetAttribute(attrOutcome, r.outcome)
+	span.SetAttribute(attrPolicyCount, len(r.policies))
+	span.SetAttribute(attrPatchCount, r.patchCount)
+}
+
+// observeCueEvaluation reports the time evaluating policies since start.
+func observeCueEvaluation(stage string, start time.Time) {
+	cueEvaluationDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,131 @@
+package pidalio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+)
+
+func TestPolicyTransport_RoundTripMetrics(t *testing.T) {
+	const apiserverLatency = 100 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		policyNames bool
+		wantKind    string
+		wantOutcome string
+		wantPolicy  string
+	}{
+		{
+			name:        "mutated",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			body:        `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","annotations":{}}}`,
+			wantKind:    "Deployment",
+			wantOutcome: outcomeMutated,
+			wantPolicy:  "",
+		},
+		{
+			name:        "mutated with policy names",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			body:        `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","annotations":{}}}`,
+			policyNames: true,
+			wantKind:    "Deployment",
+			wantOutcome: outcomeMutated,
+			wantPolicy:  "add-foo",
+		},
+		{
+			name:        "error",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			body:        `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web"}}`,
+			wantKind:    "Deployment",
+			wantOutcome: outcomeError,
+		},
+		{
+			name:        "skipped",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			contentType: "application/cbor",
+			body:        `{}`,
+			wantOutcome: outcomeSkipped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := requestsTotal.WithLabelValues("apps", "v1", tt.wantKind, "create", tt.wantOutcome)
+			before := testutil.ToFloat64(requests)
+			var applied prometheus.Counter
+			var appliedBefore float64
+			if tt.wantOutcome == outcomeMutated {
+				applied = policyApplied.WithLabelValues("apps", "v1", tt.wantKind, "create", tt.wantPolicy)
+				appliedBefore = testutil.ToFloat64(applied)
+			}
+			durationBefore := histogramSum(t, mutationDuration.WithLabelValues("apps", "v1", tt.wantKind, "create", tt.wantOutcome))
+
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   newTestOverrideManager(t),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					policyMetrics:     tt.policyNames,
+				},
+				delegate: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					// the round trip to the apiserver is not observed as mutation duration.
+					time.Sleep(apiserverLatency)
+					body, _ := ioutil.ReadAll(req.Body)
+					return newResponse(http.StatusCreated, body), nil
+				}),
+			}
+
+			req, _ := http.NewRequest(tt.method, "https://127.0.0.1"+tt.url, bytes.NewBufferString(tt.body))
+			if len(tt.contentType) != 0 {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if got := testutil.ToFloat64(requests) - before; got != 1 {
+				t.Errorf("requests_total{outcome=%q} increased by %v, want 1", tt.wantOutcome, got)
+			}
+			if applied != nil {
+				if got := testutil.ToFloat64(applied) - appliedBefore; got != 1 {
+					t.Errorf("policy_applied_total{policy=%q} increased by %v, want 1", tt.wantPolicy, got)
+				}
+			}
+			duration := mutationDuration.WithLabelValues("apps", "v1", tt.wantKind, "create", tt.wantOutcome)
+			if got := histogramSum(t, duration) - durationBefore; got >= apiserverLatency.Seconds() {
+				t.Errorf("mutation_duration_seconds increased by %v, want less than the apiserver latency", got)
+			}
+		})
+	}
+}
+
+// histogramSum returns the sum of the samples observed by observer.
+func histogramSum(t *testing.T, observer prometheus.Observer) float64 {
+	m := &dto.Metric{}
+	if err := observer.(prometheus.Metric).Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	if err := RegisterMetrics(prometheus.NewRegistry()); err != nil {
+		t.Errorf("RegisterMetrics() error = %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+package pidalio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// Mutator mutates objects in go alongside (Cluster)OverridePolicies.
+type Mutator interface {
+	// Mutate mutates obj in place. old is the current state of obj on update, it may be nil if it is not resolved.
+	Mutate(ctx context.Context, info RequestInfo, obj, old *unstructured.Unstructured) error
+}
+
+// MutatorFunc is a function implementing Mutator.
+type MutatorFunc func(ctx context.Context, info RequestInfo, obj, old *unstructured.Unstructured) error
+
+func (f MutatorFunc) Mutate(ctx context.Context, info RequestInfo, obj, old *unstructured.Unstructured) error {
+	return f(ctx, info, obj, old)
+}
+
+// MutatorPhase is when a mutator runs relative to the override policies.
+type MutatorPhase string
+
+const (
+	// BeforePolicies runs the mutator before the override policies are applied.
+	BeforePolicies MutatorPhase = "BeforePolicies"
+	// AfterPolicies runs the mutator after the override policies are applied.
+	AfterPolicies MutatorPhase = "AfterPolicies"
+)
+
+// mutatorRecordPrefix prefixes the name of a mutator recorded in the applied overrides annotation,
+// it never collides with the name of a policy.
+const mutatorRecordPrefix = "mutator:"
+
+// MutatorRegistration registers a Mutator to the transport.
+type MutatorRegistration struct {
+	// Name identifies the mutator, it is recorded in the applied overrides annotation as "mutator:<name>".
+	Name    string
+	Mutator Mutator
+	// Phase is when the mutator runs, defaults to AfterPolicies.
+	Phase MutatorPhase
+	// Order orders the mutators of the same phase in ascending, mutators with the same order run in registration order.
+	Order int
+	// Kinds are the kinds of objects the mutator runs on, it runs on all the objects if empty.
+	// An empty Version matches any version.
+	Kinds []schema.GroupVersionKind
+}
+
+// mutatorRegistry holds the registered mutators in the order they run.
+type mutatorRegistry struct {
+	lock     sync.RWMutex
+	mutators []MutatorRegistration
+}
+
+// RegisterMutator registers a mutator running on every request sent through the transport.
+// Mutators do not run on policies, like override policies.
+func (t *Transport) RegisterMutator(registration MutatorRegistration) error {
+	return t.policy.mutators.register(registration)
+}
+
+func (r *mutatorRegistry) register(registration MutatorRegistration) error {
+	if len(registration.Name) == 0 {
+		return errors.New("mutator name is required")
+	}
+	if registration.Mutator == nil {
+		return fmt.Errorf("mutator %q is nil", registration.Name)
+	}
+	switch registration.Phase {
+	case "":
+		registration.Phase = AfterPolicies
+	case BeforePolicies, AfterPolicies:
+	default:
+		return fmt.Errorf("mutator %q has unknown phase %q", registration.Name, registration.Phase)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, m := range r.mutators {
+		if m.Name == registration.Name {
+			return fmt.Errorf("mutator %q is already registered", registration.Name)
+		}
+	}
+
+	mutators := append(append([]MutatorRegistration{}, r.mutators...), registration)
+	sort.SliceStable(mutators, func(i, j int) bool {
+		return mutators[i].Order < mutators[j].Order
+	})
+	r.mutators = mutators
+
+	return nil
+}
+
+// appliedMutator is a mutator which changed an object with the json patch of the change.
+type appliedMutator struct {
+	name  string
+	patch []jsonpatchv2.JsonPatchOperation
+}
+
+// mutate runs the mutators of phase matching obj in order, and returns the ones which changed obj.
+// Every mutator runs in a span started by tracer, which may be nil.
+func (r *mutatorRegistry) mutate(ctx context.Context, tracer Tracer, phase MutatorPhase, info RequestInfo,
+	obj, oldObj *unstructured.Unstructured) ([]appliedMutator, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	r.lock.RLock()
+	mutators := r.mutators
+	r.lock.RUnlock()
+
+	var applied []appliedMutator
+	for _, m := range mutators {
+		if m.Phase != phase || !m.matches(obj.GroupVersionKind()) {
+			continue
+		}
+
+		before, err := obj.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		mutatorCtx, span := startSpan(ctx, tracer, "pidalio.Mutator")
+		span.SetAttribute(attrPolicy, m.Name)
+		err = m.Mutator.Mutate(mutatorCtx, info, obj, oldObj)
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+		if err != nil {
+			return nil, fmt.Errorf("mutator %q failed: %w", m.Name, err)
+		}
+
+		after, err := obj.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+
+		patch, err := jsonpatchv2.CreatePatch(before, after)
+		if err != nil {
+			return nil, err
+		}
+		if len(patch) == 0 {
+			continue
+		}
+
+		klog.V(4).InfoS("mutator applied.", "mutator", m.Name, "resource", klog.KObj(obj))
+		applied = append(applied, appliedMutator{name: m.Name, patch: patch})
+	}
+
+	return applied, nil
+}
+
+func (m *MutatorRegistration) matches(gvk schema.GroupVersionKind) bool {
+	if len(m.Kinds) == 0 {
+		return true
+	}
+
+	for _, kind := range m.Kinds {
+		if kind.Group == gvk.Group && kind.Kind == gvk.Kind && (len(kind.Version) == 0 || kind.Version == gvk.Version) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// shadow records what the mutator changed as plaintext overriders, the same way as a policy is recorded.
+func (m appliedMutator) shadow() (overridemanager.OverridePolicyShadow, error) {
+	shadow := overridemanager.OverridePolicyShadow{PolicyName: mutatorRecordPrefix + m.name}
+	for _, op := range m.patch {
+		overrider := policyv1alpha1.PlaintextOverrider{
+			Path:     op.Path,
+			Operator: policyv1alpha1.OverriderOperator(op.Operation),
+		}
+		if op.Operation != "remove" {
+			value, err := json.Marshal(op.Value)
+			if err != nil {
+				return shadow, err
+			}
+			overrider.Value = apiextensionsv1.JSON{Raw: value}
+		}
+		shadow.Overriders.Plaintext = append(shadow.Overriders.Plaintext, overrider)
+	}
+
+	return shadow, nil
+}
+
+// withMutators returns the applied cluster overrides with the mutators run before and after the policies.
+func withMutators(before []appliedMutator, cops *overridemanager.AppliedOverrides, after []appliedMutator) (*overridemanager.AppliedOverrides, error) {
+	if len(before) == 0 && len(after) == 0 {
+		return cops, nil
+	}
+
+	applied := &overridemanager.AppliedOverrides{}
+	for _, m := range before {
+		shadow, err := m.shadow()
+		if err != nil {
+			return nil, err
+		}
+		applied.AppliedItems = append(applied.AppliedItems, shadow)
+	}
+	if cops != nil {
+		applied.AppliedItems = append(applied.AppliedItems, cops.AppliedItems...)
+	}
+	for _, m := range after {
+		shadow, err := m.shadow()
+		if err != nil {
+			return nil, err
+		}
+		applied.AppliedItems = append(applied.AppliedItems, shadow)
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,170 @@
+package pidalio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/k-cloud-labs/pkg/utils"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestMutatorRegistry_register(t *testing.T) {
+	noop := MutatorFunc(func(ctx context.Context, info RequestInfo, obj, old *unstructured.Unstructured) error {
+		return nil
+	})
+
+	tests := []struct {
+		name          string
+		registrations []MutatorRegistration
+		wantErr       bool
+		wantOrder     []string
+	}{
+		{
+			name: "ordered by order then registration",
+			registrations: []MutatorRegistration{
+				{Name: "b", Mutator: noop, Order: 1},
+				{Name: "c", Mutator: noop},
+				{Name: "a", Mutator: noop, Order: 1},
+			},
+			wantOrder: []string{"c", "b", "a"},
+		},
+		{
+			name:          "name is required",
+			registrations: []MutatorRegistration{{Mutator: noop}},
+			wantErr:       true,
+		},
+		{
+			name:          "mutator is required",
+			registrations: []MutatorRegistration{{Name: "a"}},
+			wantErr:       true,
+		},
+		{
+			name:          "unknown phase",
+			registrations: []MutatorRegistration{{Name: "a", Mutator: noop, Phase: "Later"}},
+			wantErr:       true,
+		},
+		{
+			name:          "duplicated name",
+			registrations: []MutatorRegistration{{Name: "a", Mutator: noop}, {Name: "a", Mutator: noop}},
+			wantErr:       true,
+			wantOrder:     []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &mutatorRegistry{}
+			var err error
+			for _, registration := range tt.registrations {
+				if err = r.register(registration); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("register() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var order []string
+			for _, m := range r.mutators {
+				order = append(order, m.Name)
+			}
+			if len(order) != len(tt.wantOrder) {
+				t.Fatalf("mutators = %v, want %v", order, tt.wantOrder)
+			}
+			for i := range order {
+				if order[i] != tt.wantOrder[i] {
+					t.Errorf("mutators = %v, want %v", order, tt.wantOrder)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyTransport_RoundTripMutators(t *testing.T) {
+	setLabel := func(key, value string) MutatorFunc {
+		return func(ctx context.Context, info RequestInfo, obj, old *unstructured.Unstructured) error {
+			if info.Resource != "deployments" {
+				return errors.New("unexpected request info")
+			}
+			labels := obj.GetLabels()
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[key] = value
+			obj.SetLabels(labels)
+			return nil
+		}
+	}
+
+	registry := &mutatorRegistry{}
+	for _, registration := range []MutatorRegistration{
+		{Name: "after", Mutator: setLabel("owner", "after")},
+		{Name: "before", Mutator: setLabel("owner", "before"), Phase: BeforePolicies},
+		{Name: "unchanged", Mutator: setLabel("owner", "after"), Order: 1},
+		{Name: "other-kind", Mutator: setLabel("kind", "other"), Kinds: []schema.GroupVersionKind{{Group: "apps", Kind: "StatefulSet"}}},
+		{Name: "any-version", Mutator: setLabel("version", "any"), Kinds: []schema.GroupVersionKind{{Group: "apps", Kind: "Deployment"}}},
+	} {
+		if err := registry.register(registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := &policyTransport{
+		policyEngine: &policyEngine{
+			initialized:       1,
+			overrideManager:   newTestOverrideManager(t),
+			policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+			mutators:          registry,
+		},
+	}
+
+	var sent *unstructured.Unstructured
+	tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		sent, _ = bytesToUnstructured(body)
+		return newResponse(http.StatusCreated, body), nil
+	})
+
+	body := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","annotations":{}}}`
+	req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1/apis/apps/v1/namespaces/default/deployments", bytes.NewBufferString(body))
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+
+	labels := sent.GetLabels()
+	if labels["owner"] != "after" || labels["version"] != "any" || len(labels["kind"]) != 0 {
+		t.Errorf("labels = %v", labels)
+	}
+	if sent.GetAnnotations()["foo"] != "bar" {
+		t.Errorf("policies are not applied, annotations = %v", sent.GetAnnotations())
+	}
+
+	var applied []overridemanager.OverridePolicyShadow
+	if err := json.Unmarshal([]byte(sent.GetAnnotations()[utils.AppliedClusterOverrides]), &applied); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, item := range applied {
+		names = append(names, item.PolicyName)
+	}
+	want := []string{"mutator:before", "add-foo", "mutator:after", "mutator:any-version"}
+	if len(names) != len(want) {
+		t.Fatalf("applied = %v, want %v", names, want)
+	}
+	for i := range names {
+		if names[i] != want[i] {
+			t.Errorf("applied = %v, want %v", names, want)
+		}
+	}
+	if applied[0].Overriders.Plaintext[0].Path != "/metadata/labels" {
+		t.Errorf("mutator is recorded as %+v", applied[0].Overriders)
+	}
+}
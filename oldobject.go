@@ -0,0 +1,112 @@
+package pidalio
+
+import (
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// OldObjectOptions configures how the transport resolves the current object of an update request,
+// which is passed to policies as the old object.
+type OldObjectOptions struct {
+	// CachedResources are resources whose old object is looked up from the cache of the dynamic resource lister,
+	// which is shared with policies. Only the listed resources are registered to it.
+	CachedResources []schema.GroupVersionResource
+	// LiveGet fetches the old object from the apiserver if it is not found in the cache.
+	// Without it, the old object of an update is only resolved for CachedResources.
+	LiveGet bool
+}
+
+// resourceListers is implemented by dynamiclister.DynamicResourceLister, it caches the resources registered.
+type resourceListers interface {
+	// RegisterNewResource registers resources to be cached, waiting for them to be synced if waitForSync is true.
+	RegisterNewResource(waitForSync bool, gvrs ...schema.GroupVersionResource) error
+	// GetResourceLister returns the lister of a registered resource and whether it is synced.
+	GetResourceLister(gvr schema.GroupVersionResource) (cache.GenericLister, cache.InformerSynced, error)
+}
+
+// objectCache looks up objects of opted-in resources from the dynamic resource lister.
+type objectCache struct {
+	listers   resourceListers
+	resources map[schema.GroupVersionResource]bool
+}
+
+// newObjectCache registers resources to listers, which is usually the dynamic resource lister.
+func newObjectCache(listers resourceListers, resources []schema.GroupVersionResource) (*objectCache, error) {
+	if err := listers.RegisterNewResource(false, resources...); err != nil {
+		return nil, err
+	}
+
+	c := &objectCache{listers: listers, resources: make(map[schema.GroupVersionResource]bool, len(resources))}
+	for _, gvr := range resources {
+		c.resources[gvr] = true
+	}
+	return c, nil
+}
+
+// synced returns the functions reporting whether the resources are synced.
+func (c *objectCache) synced() map[schema.GroupVersionResource]cache.InformerSynced {
+	if c == nil {
+		return nil
+	}
+
+	synced := make(map[schema.GroupVersionResource]cache.InformerSynced, len(c.resources))
+	for gvr := range c.resources {
+		if _, informerSynced, err := c.listers.GetResourceLister(gvr); err == nil {
+			synced[gvr] = informerSynced
+		}
+	}
+	return synced
+}
+
+// get returns a copy of the object targeted by the request, or nil if it is not cached or the cache is not synced.
+func (c *objectCache) get(info *RequestInfo) *unstructured.Unstructured {
+	if c == nil || !c.resources[info.GroupVersionResource()] {
+		return nil
+	}
+
+	lister, synced, err := c.listers.GetResourceLister(info.GroupVersionResource())
+	if err != nil || !synced() {
+		return nil
+	}
+
+	var obj runtime.Object
+	if len(info.Namespace) != 0 && info.Resource != "namespaces" {
+		obj, err = lister.ByNamespace(info.Namespace).Get(info.Name)
+	} else {
+		obj, err = lister.Get(info.Name)
+	}
+	if err != nil {
+		return nil
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+
+	return u.DeepCopy()
+}
+
+// oldObject returns the current state of the object targeted by an update request, or nil if the
+// resource is not opted in. Create requests have no old object.
+func (tr *policyTransport) oldObject(req *http.Request, info *RequestInfo) (*unstructured.Unstructured, error) {
+	if info.Verb == "create" {
+		return nil, nil
+	}
+
+	if obj := tr.objectCache.get(info); obj != nil {
+		return obj, nil
+	}
+
+	if !tr.oldObjectOptions.LiveGet {
+		return nil, nil
+	}
+
+	klog.V(4).InfoS("old object is not cached, get it from apiserver.", "url", info.Path)
+	return tr.getCurrentObject(req)
+}
@@ -0,0 +1,158 @@
+package pidalio
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+// oldObjectRecorder records the old object passed to ApplyOverridePolicies.
+type oldObjectRecorder struct {
+	oldObj *unstructured.Unstructured
+	called bool
+}
+
+func (r *oldObjectRecorder) ApplyOverridePolicies(rawObj, oldObj *unstructured.Unstructured, operation admissionv1.Operation) (*overridemanager.AppliedOverrides, *overridemanager.AppliedOverrides, error) {
+	r.called = true
+	r.oldObj = oldObj
+	return nil, nil, nil
+}
+
+// fakeResourceListers lists resources from indexers.
+type fakeResourceListers struct {
+	indexers   map[schema.GroupVersionResource]cache.Indexer
+	registered []schema.GroupVersionResource
+}
+
+func (f *fakeResourceListers) RegisterNewResource(_ bool, gvrs ...schema.GroupVersionResource) error {
+	f.registered = append(f.registered, gvrs...)
+	return nil
+}
+
+func (f *fakeResourceListers) GetResourceLister(gvr schema.GroupVersionResource) (cache.GenericLister, cache.InformerSynced, error) {
+	indexer, ok := f.indexers[gvr]
+	if !ok {
+		return nil, nil, fmt.Errorf("resource %s is not registered", gvr)
+	}
+	return cache.NewGenericLister(indexer, gvr.GroupResource()), func() bool { return true }, nil
+}
+
+func TestNewObjectCache(t *testing.T) {
+	deploymentGVR := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+
+	listers := &fakeResourceListers{}
+	if _, err := newObjectCache(listers, []schema.GroupVersionResource{deploymentGVR}); err != nil {
+		t.Fatalf("newObjectCache() error = %v", err)
+	}
+	if len(listers.registered) != 1 || listers.registered[0] != deploymentGVR {
+		t.Errorf("registered resources = %v, want %v", listers.registered, deploymentGVR)
+	}
+}
+
+func TestPolicyTransport_oldObject(t *testing.T) {
+	deploymentGVR := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	cached := &unstructured.Unstructured{}
+	cached.SetAPIVersion("apps/v1")
+	cached.SetKind("Deployment")
+	cached.SetNamespace("default")
+	cached.SetName("web")
+	cached.SetLabels(map[string]string{"from": "cache"})
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(cached); err != nil {
+		t.Fatalf("failed to add object to indexer: %v", err)
+	}
+
+	live := []byte(`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","labels":{"from":"live"}}}`)
+	body := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default"}}`
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		objectCache *objectCache
+		liveGet     bool
+		wantFrom    string
+	}{
+		{
+			name:        "update from cache",
+			method:      http.MethodPut,
+			url:         "/apis/apps/v1/namespaces/default/deployments/web",
+			objectCache: newTestObjectCache(deploymentGVR, indexer),
+			wantFrom:    "cache",
+		},
+		{
+			name:     "update from live get",
+			method:   http.MethodPut,
+			url:      "/apis/apps/v1/namespaces/default/deployments/web",
+			liveGet:  true,
+			wantFrom: "live",
+		},
+		{
+			name:        "update not cached without live get",
+			method:      http.MethodPut,
+			url:         "/apis/apps/v1/namespaces/default/deployments/web",
+			objectCache: newTestObjectCache(deploymentGVR, cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		},
+		{
+			name:        "create has no old object",
+			method:      http.MethodPost,
+			url:         "/apis/apps/v1/namespaces/default/deployments",
+			objectCache: newTestObjectCache(deploymentGVR, indexer),
+			liveGet:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &oldObjectRecorder{}
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   recorder,
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					objectCache:       tt.objectCache,
+					oldObjectOptions:  OldObjectOptions{LiveGet: tt.liveGet},
+				},
+			}
+			tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					return newResponse(http.StatusOK, live), nil
+				}
+				return newResponse(http.StatusOK, nil), nil
+			})
+
+			req, _ := http.NewRequest(tt.method, "https://127.0.0.1"+tt.url, bytes.NewBufferString(body))
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if !recorder.called {
+				t.Fatalf("ApplyOverridePolicies() is not called")
+			}
+			var from string
+			if recorder.oldObj != nil {
+				from = recorder.oldObj.GetLabels()["from"]
+			}
+			if from != tt.wantFrom {
+				t.Errorf("old object from %q, want %q", from, tt.wantFrom)
+			}
+		})
+	}
+}
+
+// newTestObjectCache returns an object cache of gvr looking up objects from indexer.
+func newTestObjectCache(gvr schema.GroupVersionResource, indexer cache.Indexer) *objectCache {
+	return &objectCache{
+		listers:   &fakeResourceListers{indexers: map[schema.GroupVersionResource]cache.Indexer{gvr: indexer}},
+		resources: map[schema.GroupVersionResource]bool{gvr: true},
+	}
+}
@@ -0,0 +1,284 @@
+package pidalio
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/klog/v2"
+)
+
+// patchTypeFromContentType returns the patch type carried by a PATCH request with the given Content-Type.
+// The second return value is false if the patch type can not be mutated by the transport.
+func patchTypeFromContentType(contentType string) (types.PatchType, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	switch pt := types.PatchType(mediaType); pt {
+	case types.JSONPatchType, types.MergePatchType, types.StrategicMergePatchType:
+		return pt, true
+	default:
+		return "", false
+	}
+}
+
+// mutatePatch rebuilds the object targeted by a PATCH request from its live state, applies the patch and override
+// policies on it, and returns a patch of the same type which carries the override changes too. The object cache is
+// not used, the changes of overrides would be computed against a stale object.
+func (tr *policyTransport) mutatePatch(req *http.Request, info *RequestInfo, patch []byte, rec *mutationRecord) ([]byte, error) {
+	patchType, ok := patchTypeFromContentType(req.Header.Get("Content-Type"))
+	if !ok {
+		klog.V(4).InfoS("skip mutating unsupported patch.", "contentType", req.Header.Get("Content-Type"), "url", req.URL.Path)
+		return patch, nil
+	}
+
+	current, err := tr.getCurrentObject(req)
+	if err != nil {
+		// let the apiserver report why the object can not be patched.
+		klog.V(4).InfoS("skip mutating patch of object failed to get.", "url", req.URL.Path, "err", err)
+		return patch, nil
+	}
+	if current == nil {
+		// let the apiserver report why the object can not be patched.
+		return patch, nil
+	}
+	if patchType == types.StrategicMergePatchType && !aggregatedScheme.Recognizes(current.GroupVersionKind()) {
+		// strategic merge patch is not supported for custom resources, let the apiserver reject it.
+		return patch, nil
+	}
+
+	currentBytes, err := current.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	// a malformed patch or a failing test operation is an error of the caller, let the apiserver reject it.
+	patchedBytes, err := applyPatch(patchType, currentBytes, patch, current.GroupVersionKind())
+	if err != nil {
+		klog.V(4).InfoS("skip mutating patch failed to apply.", "url", req.URL.Path, "err", err)
+		return patch, nil
+	}
+
+	patched, err := bytesToUnstructured(patchedBytes)
+	if err != nil {
+		klog.V(4).InfoS("skip mutating patch failed to apply.", "url", req.URL.Path, "err", err)
+		return patch, nil
+	}
+
+	rec.gvk = patched.GroupVersionKind()
+
+	// excluded objects are sent untouched, but they are validated still.
+	reason := tr.exclusions.excluded(patched, info.Namespace)
+	if len(reason) != 0 {
+		klog.V(4).InfoS("skip mutating excluded object.", "url", info.Path, "reason", reason)
+		if tr.validateManager == nil {
+			return patch, nil
+		}
+	}
+
+	mutated := patched.DeepCopy()
+	defaultNamespace(mutated, info)
+	if len(reason) == 0 {
+		if err = tr.mutate(req.Context(), info, mutated, current, admissionv1.Update, rec); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tr.validate(req.Context(), info, mutated, current, admissionv1.Update); err != nil {
+		return nil, err
+	}
+
+	if len(reason) != 0 {
+		return patch, nil
+	}
+
+	mutatedBytes, err := mutated.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeOverridePatch(patchType, patch, patchedBytes, mutatedBytes, current.GroupVersionKind(), current.GetResourceVersion())
+}
+
+// getCurrentObject fetches the object targeted by req through the delegate transport.
+// It returns nil if the object can not be fetched, e.g. it does not exist or the caller is not allowed to get it.
+func (tr *policyTransport) getCurrentObject(req *http.Request) (*unstructured.Unstructured, error) {
+	u := *req.URL
+	u.RawQuery = ""
+
+	getReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	getReq.Header = req.Header.Clone()
+	getReq.Header.Del("Content-Type")
+	getReq.Header.Set("Accept", "application/json")
+
+	resp, err := tr.delegate.RoundTrip(getReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		klog.V(4).InfoS("failed to get current object.", "url", u.Path, "status", resp.StatusCode)
+		return nil, nil
+	}
+
+	return bytesToUnstructured(body)
+}
+
+// applyPatch applies patch of patchType on to the original json document.
+func applyPatch(patchType types.PatchType, original, patch []byte, gvk schema.GroupVersionKind) ([]byte, error) {
+	switch patchType {
+	case types.JSONPatchType:
+		p, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, err
+		}
+		return p.Apply(original)
+	case types.MergePatchType:
+		return jsonpatch.MergePatch(original, patch)
+	case types.StrategicMergePatchType:
+		dataStruct, err := aggregatedScheme.New(gvk)
+		if err != nil {
+			return nil, err
+		}
+		return strategicpatch.StrategicMergePatch(original, patch, dataStruct)
+	default:
+		return nil, fmt.Errorf("unsupported patch type %q", patchType)
+	}
+}
+
+// mergeOverridePatch returns a patch of patchType which applies both the original patch and the changes
+// made by overrides, which are the differences between patched and mutated.
+// The override changes are computed against the object at resourceVersion, so the patch is rejected by the apiserver
+// if the object changed since: a json patch tests the resource version, merge patches carry it as a precondition
+// unless the caller sets one.
+func mergeOverridePatch(patchType types.PatchType, patch, patched, mutated []byte, gvk schema.GroupVersionKind, resourceVersion string) ([]byte, error) {
+	switch patchType {
+	case types.JSONPatchType:
+		ops, err := jsonpatchv2.CreatePatch(patched, mutated)
+		if err != nil {
+			return nil, err
+		}
+		if len(ops) == 0 {
+			return patch, nil
+		}
+
+		// keep the original operations raw, JsonPatchOperation drops the "from" of move and copy.
+		var original []json.RawMessage
+		if err = json.Unmarshal(patch, &original); err != nil {
+			return nil, err
+		}
+		if len(resourceVersion) != 0 {
+			ops = append([]jsonpatchv2.JsonPatchOperation{{Operation: "test", Path: "/metadata/resourceVersion", Value: resourceVersion}}, ops...)
+		}
+		for _, op := range ops {
+			opBytes, err := json.Marshal(op)
+			if err != nil {
+				return nil, err
+			}
+			original = append(original, opBytes)
+		}
+		return json.Marshal(original)
+	case types.MergePatchType:
+		overridePatch, err := jsonpatch.CreateMergePatch(patched, mutated)
+		if err != nil {
+			return nil, err
+		}
+		var overrides map[string]interface{}
+		if err = json.Unmarshal(overridePatch, &overrides); err != nil {
+			return nil, err
+		}
+		if len(overrides) == 0 {
+			return patch, nil
+		}
+
+		mergedBytes, err := jsonpatch.MergeMergePatches(patch, overridePatch)
+		if err != nil {
+			return nil, err
+		}
+		var merged map[string]interface{}
+		if err = json.Unmarshal(mergedBytes, &merged); err != nil {
+			return nil, err
+		}
+		if err = setResourceVersionPrecondition(merged, patch, resourceVersion); err != nil {
+			return nil, err
+		}
+		return json.Marshal(merged)
+	case types.StrategicMergePatchType:
+		dataStruct, err := aggregatedScheme.New(gvk)
+		if err != nil {
+			return nil, err
+		}
+		lookupPatchMeta, err := strategicpatch.NewPatchMetaFromStruct(dataStruct)
+		if err != nil {
+			return nil, err
+		}
+
+		var originalPatch, patchedMap, mutatedMap strategicpatch.JSONMap
+		if err = json.Unmarshal(patch, &originalPatch); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(patched, &patchedMap); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(mutated, &mutatedMap); err != nil {
+			return nil, err
+		}
+
+		overridePatch, err := strategicpatch.CreateTwoWayMergeMapPatchUsingLookupPatchMeta(patchedMap, mutatedMap, lookupPatchMeta)
+		if err != nil {
+			return nil, err
+		}
+		if len(overridePatch) == 0 {
+			return patch, nil
+		}
+
+		merged, err := strategicpatch.MergeStrategicMergeMapPatchUsingLookupPatchMeta(lookupPatchMeta, originalPatch, overridePatch)
+		if err != nil {
+			return nil, err
+		}
+		if err = setResourceVersionPrecondition(merged, patch, resourceVersion); err != nil {
+			return nil, err
+		}
+		return json.Marshal(merged)
+	default:
+		return nil, fmt.Errorf("unsupported patch type %q", patchType)
+	}
+}
+
+// setResourceVersionPrecondition sets metadata.resourceVersion of the merge patch merged to resourceVersion, unless
+// it is empty or the original patch of the caller sets it already.
+func setResourceVersionPrecondition(merged map[string]interface{}, original []byte, resourceVersion string) error {
+	if len(resourceVersion) == 0 {
+		return nil
+	}
+
+	var originalPatch map[string]interface{}
+	if err := json.Unmarshal(original, &originalPatch); err != nil {
+		return err
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(originalPatch, "metadata", "resourceVersion"); found {
+		return nil
+	}
+
+	return unstructured.SetNestedField(merged, resourceVersion, "metadata", "resourceVersion")
+}
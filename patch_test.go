@@ -0,0 +1,217 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/test/mock"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+var deploymentGVK = appsv1.SchemeGroupVersion.WithKind("Deployment")
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func newResponse(code int, body []byte) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+// newTestOverrideManager returns an override manager with a ClusterOverridePolicy which adds
+// annotation foo=bar on create and update.
+func newTestOverrideManager(t *testing.T) overridemanager.OverrideManager {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	copLister := mock.NewMockClusterOverridePolicyLister(ctrl)
+	opLister := mock.NewMockOverridePolicyLister(ctrl)
+
+	opLister.EXPECT().List(labels.Everything()).Return(nil, nil).AnyTimes()
+	copLister.EXPECT().List(labels.Everything()).Return([]*policyv1alpha1.ClusterOverridePolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "add-foo"},
+			Spec: policyv1alpha1.OverridePolicySpec{
+				OverrideRules: []policyv1alpha1.RuleWithOperation{
+					{
+						TargetOperations: []admissionv1.Operation{admissionv1.Create, admissionv1.Update},
+						Overriders: policyv1alpha1.Overriders{
+							Plaintext: []policyv1alpha1.PlaintextOverrider{
+								{
+									Path:     "/metadata/annotations/foo",
+									Operator: "add",
+									Value:    apiextensionsv1.JSON{Raw: []byte(`"bar"`)},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, nil).AnyTimes()
+
+	return overridemanager.NewOverrideManager(nil, copLister, opLister)
+}
+
+func TestPolicyTransport_RoundTripPatch(t *testing.T) {
+	current := []byte(`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","resourceVersion":"1","annotations":{"owner":"pidalio"}}}`)
+	changed := bytes.Replace(current, []byte(`"resourceVersion":"1"`), []byte(`"resourceVersion":"2"`), 1)
+
+	tests := []struct {
+		name          string
+		contentType   string
+		patch         string
+		currentStatus int
+		getErr        error
+		wantMutated   bool
+	}{
+		{
+			name:          "json patch",
+			contentType:   string(types.JSONPatchType),
+			patch:         `[{"op":"add","path":"/metadata/labels","value":{"app":"web"}}]`,
+			currentStatus: http.StatusOK,
+			wantMutated:   true,
+		},
+		{
+			name:          "merge patch",
+			contentType:   string(types.MergePatchType),
+			patch:         `{"metadata":{"labels":{"app":"web"}}}`,
+			currentStatus: http.StatusOK,
+			wantMutated:   true,
+		},
+		{
+			name:          "strategic merge patch",
+			contentType:   string(types.StrategicMergePatchType) + "; charset=utf-8",
+			patch:         `{"metadata":{"labels":{"app":"web"}}}`,
+			currentStatus: http.StatusOK,
+			wantMutated:   true,
+		},
+		{
+			name:          "object not found",
+			contentType:   string(types.MergePatchType),
+			patch:         `{"metadata":{"labels":{"app":"web"}}}`,
+			currentStatus: http.StatusNotFound,
+			wantMutated:   false,
+		},
+		{
+			name:          "failed to get object",
+			contentType:   string(types.MergePatchType),
+			patch:         `{"metadata":{"labels":{"app":"web"}}}`,
+			currentStatus: http.StatusOK,
+			getErr:        errors.New("connection reset"),
+			wantMutated:   false,
+		},
+		{
+			name:          "failing test operation",
+			contentType:   string(types.JSONPatchType),
+			patch:         `[{"op":"test","path":"/metadata/labels/app","value":"web"}]`,
+			currentStatus: http.StatusOK,
+			wantMutated:   false,
+		},
+		{
+			name:          "malformed patch",
+			contentType:   string(types.MergePatchType),
+			patch:         `{"metadata":`,
+			currentStatus: http.StatusOK,
+			wantMutated:   false,
+		},
+		{
+			name:          "unsupported patch type",
+			contentType:   "application/x-unknown",
+			patch:         `{"metadata":{"labels":{"app":"web"}}}`,
+			currentStatus: http.StatusOK,
+			wantMutated:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent []byte
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   newTestOverrideManager(t),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+				},
+			}
+			tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					if req.URL.RawQuery != "" {
+						t.Errorf("get current object with query %q", req.URL.RawQuery)
+					}
+					if tt.getErr != nil {
+						return nil, tt.getErr
+					}
+					return newResponse(tt.currentStatus, current), nil
+				}
+				sent, _ = ioutil.ReadAll(req.Body)
+				return newResponse(http.StatusOK, nil), nil
+			})
+
+			req, _ := http.NewRequest(http.MethodPatch, "https://127.0.0.1/apis/apps/v1/namespaces/default/deployments/web?fieldManager=test", bytes.NewBufferString(tt.patch))
+			req.Header.Set("Content-Type", tt.contentType)
+			if _, err := tr.RoundTrip(req); err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+
+			if !tt.wantMutated {
+				if string(sent) != tt.patch {
+					t.Errorf("RoundTrip() sent patch = %s, want %s", sent, tt.patch)
+				}
+				return
+			}
+
+			patchType, _ := patchTypeFromContentType(tt.contentType)
+			result, err := applyPatch(patchType, current, sent, deploymentGVK)
+			if err != nil {
+				t.Fatalf("failed to apply sent patch %s: %v", sent, err)
+			}
+			obj, err := bytesToUnstructured(result)
+			if err != nil {
+				t.Fatalf("bytesToUnstructured() error = %v", err)
+			}
+			if obj.GetLabels()["app"] != "web" {
+				t.Errorf("RoundTrip() lost the caller's change, got labels %v", obj.GetLabels())
+			}
+			if obj.GetAnnotations()["foo"] != "bar" || obj.GetAnnotations()["owner"] != "pidalio" {
+				t.Errorf("RoundTrip() got annotations %v, want foo=bar and owner=pidalio", obj.GetAnnotations())
+			}
+
+			// the override changes must not apply on an object changed since: json patches test the resource
+			// version, merge patches carry it as a precondition checked by the apiserver.
+			if patchType == types.JSONPatchType {
+				if _, err = applyPatch(patchType, changed, sent, deploymentGVK); err == nil {
+					t.Errorf("apply sent patch %s on changed object error = nil, want error", sent)
+				}
+			} else {
+				var sentPatch map[string]interface{}
+				if err = json.Unmarshal(sent, &sentPatch); err != nil {
+					t.Fatal(err)
+				}
+				if rv, _, _ := unstructured.NestedString(sentPatch, "metadata", "resourceVersion"); rv != "1" {
+					t.Errorf("RoundTrip() sent patch %s, want precondition resourceVersion 1", sent)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package pidalio
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+)
+
+// Options are the options to set up the policy transport.
+type Options struct {
+	// SyncTimeout is the max duration WaitForSync waits for policies to be synced, zero means no timeout.
+	SyncTimeout time.Duration
+	// OldObject configures how the old object of an update request is resolved for policies.
+	OldObject OldObjectOptions
+	// FailurePolicy defines how errors evaluating policies are handled, defaults to Fail.
+	// It can be overridden by a (Cluster)OverridePolicy with annotation FailurePolicyAnnotation.
+	FailurePolicy FailurePolicyType
+	// EnableValidatePolicy evaluates ClusterValidatePolicies after mutation and rejects denied requests
+	// locally with the same status as the apiserver. It requires the ClusterValidatePolicy CRD.
+	EnableValidatePolicy bool
+	// LastSyncTime configures stamping policies with the last sync time annotation, it is disabled by default.
+	LastSyncTime LastSyncTimeOptions
+	// PolicySource is where policies are loaded from, e.g. files for air-gapped environments.
+	// Policies are watched from the apiserver if it is nil, which requires the CRDs. New does not contact the
+	// apiserver if it is set, so old objects are not resolved from CachedResources and policies can not refer to
+	// other objects of the cluster then.
+	PolicySource lister.PolicySource
+	// PolicyInformerScope limits the policies watched from the apiserver to some namespaces and labels, so that
+	// list and watch RBAC is only required in these namespaces. Policies are watched cluster-wide if it is nil,
+	// it is ignored if PolicySource is set.
+	PolicyInformerScope *lister.InformerScope
+	// Tracer traces the requests mutated by the transport, tracing is disabled if it is nil.
+	Tracer Tracer
+	// PolicyMetrics records the names of the policies in the policy label of the metrics. The label is empty by
+	// default, because every policy adds new series.
+	PolicyMetrics bool
+	// Exclusions configures the objects sent untouched, objects in kube-system are excluded by default.
+	Exclusions ExclusionOptions
+	// ClientName identifies the client in ClientIdentity, which is selected by annotation
+	// policy.kcloudlabs.io/client-selector on policies.
+	ClientName string
+	// Apply configures how server-side apply requests are mutated.
+	Apply ApplyOptions
+	// IdempotentOverrides skips the policies already reflected in the object on update: the policies recorded by
+	// the applied overrides annotations of the object with the same overriders. Without it, overriders like adding
+	// to an array are applied again on every update. If only some of the policies are reflected, the policies are
+	// evaluated twice on update: once to find out the reflected ones, and once more to apply the others.
+	IdempotentOverrides bool
+	// Reconcile configures updating existing objects when policies are added or changed, it is disabled by default.
+	// It requires IdempotentOverrides.
+	Reconcile ReconcileOptions
+	// Events configures recording Kubernetes events of policies, it is disabled by default.
+	Events EventsOptions
+	// AllowMissingCRDs starts the transport even if the CRDs of the policies watched are not installed. Requests
+	// are passed through untouched until the CRDs are installed, CustomResourceDefinitions are watched to start
+	// watching policies then. Watching CustomResourceDefinitions requires cluster-wide list and watch permissions,
+	// without them the policy CRDs are discovered again every 30 seconds instead. It is ignored if PolicySource is set.
+	AllowMissingCRDs bool
+}
+
+// Readiness is the readiness state of the transport.
+type Readiness string
+
+const (
+	// NotStarted means the transport is not started.
+	NotStarted Readiness = "NotStarted"
+	// WaitingForCRDs means the policy CRDs are not installed yet, requests are passed through untouched, see
+	// Options.AllowMissingCRDs.
+	WaitingForCRDs Readiness = "WaitingForCRDs"
+	// Syncing means policies are being loaded, requests are mutated by the policies loaded so far, or passed through
+	// untouched if the policy CRDs were missing at start. Status.SyncError reports why policies are not loaded.
+	Syncing Readiness = "Syncing"
+	// Ready means policies are loaded.
+	Ready Readiness = "Ready"
+	// Stopped means the transport is stopped.
+	Stopped Readiness = "Stopped"
+)
+
+// Transport is a handle of the policy transport registered to a rest.Config.
+// Clients built from the config after New returns mutate their requests by policies
+// once the transport is started and synced.
+type Transport struct {
+	opts   Options
+	policy *policyEngine
+	setup  *setupManager
+
+	startOnce sync.Once
+	startedCh chan struct{}
+	stopOnce  sync.Once
+	stopCh    chan struct{}
+}
+
+// New sets up the policy transport and registers it to the wrapper of config.
+// It does not start watching policies, call Start and WaitForSync before sending requests.
+// Clients built from config pass requests through untouched if New returns an error.
+func New(config *rest.Config, opts Options) (*Transport, error) {
+	t := &Transport{
+		opts: opts,
+		policy: &policyEngine{oldObjectOptions: opts.OldObject, mutators: &mutatorRegistry{}, tracer: opts.Tracer,
+			exclusions: newExclusions(opts.Exclusions), clientName: opts.ClientName, username: config.Username,
+			applyOptions: opts.Apply, idempotentOverrides: opts.IdempotentOverrides, pathPrefix: requestPathPrefix(config),
+			policyMetrics: opts.PolicyMetrics},
+		setup:     &setupManager{rawConfig: rest.CopyConfig(config)},
+		startedCh: make(chan struct{}),
+		stopCh:    make(chan struct{}),
+	}
+	config.Wrap(t.policy.Wrap)
+
+	if err := t.setup.setupAll(config, t.stopCh, opts); err != nil {
+		t.Stop()
+		return nil, err
+	}
+
+	t.policy.overrideManager = t.setup.overrideManager
+	t.policy.policyInterrupter = t.setup.policyInterrupterManager
+	t.policy.drLister = t.setup.drLister
+	t.policy.copLister = t.setup.copLister
+	t.policy.opLister = t.setup.opLister
+	t.policy.validateManager = t.setup.validateManager
+	t.policy.failurePolicy = t.setup.failurePolicyResolver(opts.FailurePolicy)
+	t.policy.objectCache = t.setup.objectCache
+	t.policy.events = t.setup.events
+	t.policy.crds = t.setup.crds
+	t.policy.status = t.setup.status
+	t.policy.clientSelectors = t.setup.clientSelectors
+	atomic.StoreInt32(&t.policy.initialized, 1)
+
+	return t, nil
+}
+
+// Start starts watching policies. The transport is stopped when ctx is done.
+// It is a no-op if the transport is already started.
+func (t *Transport) Start(ctx context.Context) error {
+	select {
+	case <-t.stopCh:
+		return errors.New("transport is stopped")
+	default:
+	}
+
+	var err error
+	t.startOnce.Do(func() {
+		if err = t.setup.start(); err != nil {
+			t.Stop()
+			return
+		}
+		close(t.startedCh)
+
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.Stop()
+			case <-t.stopCh:
+			}
+		}()
+	})
+
+	return err
+}
+
+// WaitForSync waits for policies to be synced. It returns an error if the caches are not synced
+// before ctx is done, SyncTimeout elapses or the transport is stopped. It returns ErrPolicyCRDsMissing
+// without waiting if the policy CRDs are missing and Options.AllowMissingCRDs is set.
+func (t *Transport) WaitForSync(ctx context.Context) error {
+	select {
+	case <-t.startedCh:
+	default:
+		return errors.New("transport is not started")
+	}
+
+	if t.setup.crds.waitingForCRDs() {
+		return ErrPolicyCRDsMissing
+	}
+
+	var cancel context.CancelFunc
+	if t.opts.SyncTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.opts.SyncTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	if err := t.setup.waitForCacheSync(mergeDone(ctx.Done(), t.stopCh)); err != nil {
+		return err
+	}
+
+	// the changes of policies watched from the apiserver are recorded by their events.
+	if t.setup.policyInformers == nil {
+		t.setup.status.policiesChanged()
+	}
+	return nil
+}
+
+// Readiness returns the readiness state of the transport.
+func (t *Transport) Readiness() Readiness {
+	select {
+	case <-t.stopCh:
+		return Stopped
+	default:
+	}
+
+	select {
+	case <-t.startedCh:
+	default:
+		return NotStarted
+	}
+
+	switch {
+	case t.setup.crds.waitingForCRDs():
+		return WaitingForCRDs
+	case t.setup.policiesSynced():
+		return Ready
+	default:
+		return Syncing
+	}
+}
+
+// Stop stops watching policies. It is safe to call Stop more than once.
+func (t *Transport) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopCh)
+	})
+}
+
+// mergeDone returns a channel which is closed when any of the given channels is closed.
+func mergeDone(a, b <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-a:
+		case <-b:
+		}
+	}()
+	return done
+}
@@ -0,0 +1,186 @@
+package pidalio
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+// unreachableConfig returns a config of an apiserver refusing connections.
+func unreachableConfig() *rest.Config {
+	return &rest.Config{Host: "https://127.0.0.1:1", Timeout: time.Second}
+}
+
+// unsyncedPolicySource is a policy source which never syncs.
+type unsyncedPolicySource struct {
+	lister.PolicySource
+}
+
+func (unsyncedPolicySource) HasSynced(schema.GroupVersionResource) bool {
+	return false
+}
+
+func newTestPolicySource(t *testing.T) lister.PolicySource {
+	source, err := lister.NewMemoryPolicySource(
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func TestNew_StaticPolicySource(t *testing.T) {
+	tr, err := New(unreachableConfig(), Options{PolicySource: newTestPolicySource(t), EnableValidatePolicy: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer tr.Stop()
+
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := tr.WaitForSync(context.Background()); err != nil {
+		t.Fatalf("WaitForSync() error = %v", err)
+	}
+	if got := tr.Readiness(); got != Ready {
+		t.Errorf("Readiness() = %v, want %v", got, Ready)
+	}
+	if tr.Status().LastPolicyChange.IsZero() {
+		t.Errorf("Status().LastPolicyChange is zero, want the time policies were synced")
+	}
+}
+
+func TestNew_Error(t *testing.T) {
+	body := []byte(`{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"cm","namespace":"default"}}`)
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ = ioutil.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(received)
+	}))
+	defer server.Close()
+
+	// caching old objects requires policies to be watched from the apiserver.
+	opts := Options{PolicySource: newTestPolicySource(t)}
+	opts.OldObject.CachedResources = []schema.GroupVersionResource{{Version: "v1", Resource: "configmaps"}}
+	config := &rest.Config{Host: server.URL}
+	if _, err := New(config, opts); err == nil {
+		t.Fatal("New() error = nil, want error")
+	}
+
+	// the config stays wrapped, requests are passed through untouched.
+	rt, err := rest.TransportFor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/api/v1/namespaces/default/configmaps", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	resp.Body.Close()
+	if !bytes.Equal(received, body) {
+		t.Errorf("RoundTrip() sent %s, want %s", received, body)
+	}
+}
+
+func TestTransport_Lifecycle(t *testing.T) {
+	tr, err := New(unreachableConfig(), Options{PolicySource: newTestPolicySource(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tr.Readiness(); got != NotStarted {
+		t.Errorf("Readiness() = %v, want %v", got, NotStarted)
+	}
+	if err := tr.WaitForSync(context.Background()); err == nil {
+		t.Error("WaitForSync() error = nil before Start, want error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := tr.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	if err := tr.Start(ctx); err != nil {
+		t.Errorf("Start() again error = %v, want nil", err)
+	}
+	if err := tr.WaitForSync(ctx); err != nil {
+		t.Fatalf("WaitForSync() error = %v", err)
+	}
+	if got := tr.Readiness(); got != Ready {
+		t.Errorf("Readiness() = %v, want %v", got, Ready)
+	}
+
+	tr.Stop()
+	tr.Stop()
+	if got := tr.Readiness(); got != Stopped {
+		t.Errorf("Readiness() = %v, want %v", got, Stopped)
+	}
+	if err := tr.Start(ctx); err == nil {
+		t.Error("Start() error = nil after Stop, want error")
+	}
+}
+
+func TestTransport_StopOnContextDone(t *testing.T) {
+	tr, err := New(unreachableConfig(), Options{PolicySource: newTestPolicySource(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tr.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return tr.Readiness() == Stopped, nil
+	}); err != nil {
+		t.Errorf("Readiness() = %v, want %v once ctx is done", tr.Readiness(), Stopped)
+	}
+}
+
+func TestTransport_WaitForSyncTimeout(t *testing.T) {
+	opts := Options{PolicySource: unsyncedPolicySource{newTestPolicySource(t)}, SyncTimeout: 100 * time.Millisecond}
+	tr, err := New(unreachableConfig(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Stop()
+
+	if err := tr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.WaitForSync(context.Background()); err == nil {
+		t.Error("WaitForSync() error = nil, want error once SyncTimeout elapses")
+	}
+	if got := tr.Readiness(); got != Syncing {
+		t.Errorf("Readiness() = %v, want %v", got, Syncing)
+	}
+}
+
+func TestNew_ReconcileRequiresIdempotentOverrides(t *testing.T) {
+	opts := Options{PolicySource: newTestPolicySource(t), Reconcile: ReconcileOptions{Enabled: true}}
+	_, err := New(&rest.Config{Host: "https://127.0.0.1:1"}, opts)
+	if err == nil || !strings.Contains(err.Error(), "IdempotentOverrides") {
+		t.Errorf("New() error = %v, want error requiring IdempotentOverrides", err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"errors"
+
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+)
+
+var errReadOnlyIndexer = errors.New("merged indexer is read only")
+
+// mergedIndexer is a read only indexer over indexers holding distinct objects, e.g. the indexers of the informers
+// watching different namespaces.
+type mergedIndexer struct {
+	indexers []cache.Indexer
+}
+
+var _ cache.Indexer = &mergedIndexer{}
+
+// NewMergedIndexer returns a read only indexer listing the objects of all indexers, which must hold distinct
+// objects with the same indexers.
+func NewMergedIndexer(indexers ...cache.Indexer) cache.Indexer {
+	if len(indexers) == 1 {
+		return indexers[0]
+	}
+
+	return &mergedIndexer{indexers: indexers}
+}
+
+// NewMultiNamespaceOverridePolicyLister returns an OverridePolicyLister listing the OverridePolicies of the
+// indexers watching different namespaces.
+func NewMultiNamespaceOverridePolicyLister(indexers ...cache.Indexer) v1alpha1.OverridePolicyLister {
+	return NewUnstructuredOverridePolicyLister(NewMergedIndexer(indexers...))
+}
+
+func (m *mergedIndexer) Add(interface{}) error {
+	return errReadOnlyIndexer
+}
+
+func (m *mergedIndexer) Update(interface{}) error {
+	return errReadOnlyIndexer
+}
+
+func (m *mergedIndexer) Delete(interface{}) error {
+	return errReadOnlyIndexer
+}
+
+func (m *mergedIndexer) Replace([]interface{}, string) error {
+	return errReadOnlyIndexer
+}
+
+func (m *mergedIndexer) Resync() error {
+	return nil
+}
+
+func (m *mergedIndexer) List() []interface{} {
+	var ret []interface{}
+	for _, indexer := range m.indexers {
+		ret = append(ret, indexer.List()...)
+	}
+	return ret
+}
+
+func (m *mergedIndexer) ListKeys() []string {
+	var ret []string
+	for _, indexer := range m.indexers {
+		ret = append(ret, indexer.ListKeys()...)
+	}
+	return ret
+}
+
+func (m *mergedIndexer) Get(obj interface{}) (interface{}, bool, error) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return nil, false, err
+	}
+	return m.GetByKey(key)
+}
+
+func (m *mergedIndexer) GetByKey(key string) (interface{}, bool, error) {
+	for _, indexer := range m.indexers {
+		item, exists, err := indexer.GetByKey(key)
+		if err != nil || exists {
+			return item, exists, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (m *mergedIndexer) Index(indexName string, obj interface{}) ([]interface{}, error) {
+	var ret []interface{}
+	for _, indexer := range m.indexers {
+		items, err := indexer.Index(indexName, obj)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, items...)
+	}
+	return ret, nil
+}
+
+func (m *mergedIndexer) IndexKeys(indexName, indexedValue string) ([]string, error) {
+	var ret []string
+	for _, indexer := range m.indexers {
+		keys, err := indexer.IndexKeys(indexName, indexedValue)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, keys...)
+	}
+	return ret, nil
+}
+
+func (m *mergedIndexer) ListIndexFuncValues(indexName string) []string {
+	var ret []string
+	for _, indexer := range m.indexers {
+		ret = append(ret, indexer.ListIndexFuncValues(indexName)...)
+	}
+	return ret
+}
+
+func (m *mergedIndexer) ByIndex(indexName, indexedValue string) ([]interface{}, error) {
+	var ret []interface{}
+	for _, indexer := range m.indexers {
+		items, err := indexer.ByIndex(indexName, indexedValue)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, items...)
+	}
+	return ret, nil
+}
+
+func (m *mergedIndexer) GetIndexers() cache.Indexers {
+	if len(m.indexers) == 0 {
+		return cache.Indexers{}
+	}
+	return m.indexers[0].GetIndexers()
+}
+
+func (m *mergedIndexer) AddIndexers(cache.Indexers) error {
+	return errReadOnlyIndexer
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+)
+
+var (
+	// OverridePolicyResource is the resource of OverridePolicy.
+	OverridePolicyResource = policyv1alpha1.SchemeGroupVersion.WithResource("overridepolicies")
+	// ClusterOverridePolicyResource is the resource of ClusterOverridePolicy.
+	ClusterOverridePolicyResource = policyv1alpha1.SchemeGroupVersion.WithResource("clusteroverridepolicies")
+	// ClusterValidatePolicyResource is the resource of ClusterValidatePolicy.
+	ClusterValidatePolicyResource = policyv1alpha1.SchemeGroupVersion.WithResource("clustervalidatepolicies")
+
+	// policyResources maps the kinds of policies to their resources.
+	policyResources = map[string]schema.GroupVersionResource{
+		"OverridePolicy":        OverridePolicyResource,
+		"ClusterOverridePolicy": ClusterOverridePolicyResource,
+		"ClusterValidatePolicy": ClusterValidatePolicyResource,
+	}
+)
+
+// PolicySource provides policies as unstructured objects to the listers.
+type PolicySource interface {
+	// Indexer returns the indexer holding policies of the given resource.
+	// Policies are keyed by cache.MetaNamespaceKeyFunc and indexed by namespace.
+	Indexer(resource schema.GroupVersionResource) cache.Indexer
+	// HasSynced returns true if policies of the given resource are loaded.
+	HasSynced(resource schema.GroupVersionResource) bool
+	// Start starts loading policies until stopCh is closed.
+	Start(stopCh <-chan struct{}) error
+}
+
+// NewOverridePolicyLister returns a new OverridePolicyLister listing policies from source.
+func NewOverridePolicyLister(source PolicySource) v1alpha1.OverridePolicyLister {
+	return NewUnstructuredOverridePolicyLister(source.Indexer(OverridePolicyResource))
+}
+
+// NewClusterOverridePolicyLister returns a new ClusterOverridePolicyLister listing policies from source.
+func NewClusterOverridePolicyLister(source PolicySource) v1alpha1.ClusterOverridePolicyLister {
+	return NewUnstructuredClusterOverridePolicyLister(source.Indexer(ClusterOverridePolicyResource))
+}
+
+// NewClusterValidatePolicyLister returns a new ClusterValidatePolicyLister listing policies from source.
+func NewClusterValidatePolicyLister(source PolicySource) v1alpha1.ClusterValidatePolicyLister {
+	return NewUnstructuredClusterValidatePolicyLister(source.Indexer(ClusterValidatePolicyResource))
+}
+
+// policyResourceOf returns the resource of a policy object.
+func policyResourceOf(obj *unstructured.Unstructured) (schema.GroupVersionResource, error) {
+	gvk := obj.GroupVersionKind()
+	resource, ok := policyResources[gvk.Kind]
+	if !ok || gvk.GroupVersion() != policyv1alpha1.SchemeGroupVersion {
+		return schema.GroupVersionResource{}, fmt.Errorf("unsupported policy kind %q", gvk)
+	}
+
+	return resource, nil
+}
+
+func newPolicyIndexer() cache.Indexer {
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog/v2"
+)
+
+// reloadDelay is the delay to reload policies after files change, so a burst of writes causes one reload.
+const reloadDelay = 100 * time.Millisecond
+
+// FilePolicySource loads policies from yaml or json files and directories, multiple policies can be put in
+// one file separated by "---". Policies are reloaded when the files change after it is started.
+type FilePolicySource struct {
+	*MemoryPolicySource
+
+	paths []string
+	mu    sync.Mutex
+}
+
+var _ PolicySource = &FilePolicySource{}
+
+// NewFilePolicySource returns a FilePolicySource loading policies from paths. A path is a file, or a directory whose
+// *.yaml, *.yml and *.json files are loaded, subdirectories are skipped.
+func NewFilePolicySource(paths ...string) (*FilePolicySource, error) {
+	memory, err := NewMemoryPolicySource()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FilePolicySource{MemoryPolicySource: memory, paths: paths}
+	if err = s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload loads policies from the files again. Policies are kept untouched if any file fails to load.
+func (s *FilePolicySource) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var policies []interface{}
+	for _, path := range s.paths {
+		files, err := policyFiles(path)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			loaded, err := loadPolicyFile(os.DirFS(filepath.Dir(file)), filepath.Base(file))
+			if err != nil {
+				return err
+			}
+			policies = append(policies, loaded...)
+		}
+	}
+
+	return s.Replace(policies...)
+}
+
+// Start watches the files and reloads policies when they change until stopCh is closed.
+func (s *FilePolicySource) Start(stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// watch directories rather than files, editors replace files by renaming which stops watching them.
+	for _, path := range s.paths {
+		dir := path
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			dir = filepath.Dir(path)
+		}
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return err
+		}
+	}
+
+	go s.watch(watcher, stopCh)
+
+	return nil
+}
+
+func (s *FilePolicySource) watch(watcher *fsnotify.Watcher, stopCh <-chan struct{}) {
+	defer watcher.Close()
+
+	reload := time.NewTimer(reloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// the files of ConfigMap and Secret volumes are symlinks, kubelet swaps the ..data symlink to their
+			// directory so no event is sent for them. Reload on any event, only policy files are loaded.
+			klog.V(4).InfoS("policy files changed.", "event", event)
+			reload.Reset(reloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.ErrorS(err, "failed to watch policy files.")
+		case <-reload.C:
+			if err := s.Reload(); err != nil {
+				klog.ErrorS(err, "failed to reload policy files, keep the loaded policies.", "paths", s.paths)
+				continue
+			}
+			klog.InfoS("reloaded policy files.", "paths", s.paths)
+		}
+	}
+}
+
+// NewFSPolicySource returns a PolicySource holding policies loaded from the *.yaml, *.yml and *.json files of fsys,
+// e.g. an embed.FS. Subdirectories are walked.
+func NewFSPolicySource(fsys fs.FS) (PolicySource, error) {
+	var policies []interface{}
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isPolicyFile(path) {
+			return nil
+		}
+
+		loaded, err := loadPolicyFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		policies = append(policies, loaded...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMemoryPolicySource(policies...)
+}
+
+// policyFiles returns path if it is a file, or the policy files in it if it is a directory.
+func policyFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isPolicyFile(entry.Name()) {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+func isPolicyFile(name string) bool {
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json":
+		return true
+	default:
+		return false
+	}
+}
+
+// loadPolicyFile decodes all the policies in a yaml or json file.
+func loadPolicyFile(fsys fs.FS, name string) ([]interface{}, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var policies []interface{}
+	decoder := utilyaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		obj := &unstructured.Unstructured{}
+		if err = decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		if len(obj.Object) == 0 {
+			continue
+		}
+
+		if _, err = policyResourceOf(obj); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", name, err)
+		}
+		policies = append(policies, obj)
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/k-cloud-labs/pkg/utils/informermanager"
+)
+
+// informerPolicySource watches policies from the apiserver by informers.
+type informerPolicySource struct {
+	manager informermanager.SingleClusterInformerManager
+}
+
+// NewInformerPolicySource returns a PolicySource watching policies from the apiserver by the informers of manager.
+// Informers are created on demand, so only the resources listed are watched.
+func NewInformerPolicySource(manager informermanager.SingleClusterInformerManager) InformerPolicySource {
+	return &informerPolicySource{manager: manager}
+}
+
+func (s *informerPolicySource) Informers(resource schema.GroupVersionResource) []cache.SharedIndexInformer {
+	return []cache.SharedIndexInformer{s.manager.Informer(resource)}
+}
+
+func (s *informerPolicySource) Indexer(resource schema.GroupVersionResource) cache.Indexer {
+	return s.manager.Informer(resource).GetIndexer()
+}
+
+func (s *informerPolicySource) HasSynced(resource schema.GroupVersionResource) bool {
+	return s.manager.Informer(resource).HasSynced()
+}
+
+func (s *informerPolicySource) Start(_ <-chan struct{}) error {
+	s.manager.Start()
+	return nil
+}
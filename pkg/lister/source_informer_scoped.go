@@ -0,0 +1,137 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// InformerScope scopes the policies watched from the apiserver, so that only the RBAC to list and watch them is
+// required.
+type InformerScope struct {
+	// Namespaces are the namespaces OverridePolicies are watched in, all namespaces are watched if it is empty.
+	Namespaces []string
+	// LabelSelector selects the policies watched, e.g. "pidalio.io/client=billing". All policies are watched if
+	// it is empty.
+	LabelSelector string
+	// SkipClusterOverridePolicies skips watching ClusterOverridePolicies, no ClusterOverridePolicy is listed then.
+	SkipClusterOverridePolicies bool
+}
+
+// InformerPolicySource is a PolicySource watching policies from the apiserver by informers.
+type InformerPolicySource interface {
+	PolicySource
+	// Informers returns the informers watching policies of the given resource, none if it is not watched.
+	Informers(resource schema.GroupVersionResource) []cache.SharedIndexInformer
+}
+
+// scopedInformerPolicySource watches policies in some namespaces and with some labels only.
+type scopedInformerPolicySource struct {
+	scope InformerScope
+	// namespaced are the informer factories of namespaced policies, one per namespace.
+	namespaced []dynamicinformer.DynamicSharedInformerFactory
+	// cluster is the informer factory of cluster scoped policies.
+	cluster dynamicinformer.DynamicSharedInformerFactory
+
+	lock sync.Mutex
+	// skipped is the empty indexer of the resources not watched.
+	skipped cache.Indexer
+}
+
+// NewScopedInformerPolicySource returns a PolicySource watching the policies in scope from the apiserver by client.
+// The OverridePolicies of every namespace are held by an indexer of their own, which are merged behind the listers.
+func NewScopedInformerPolicySource(client dynamic.Interface, scope InformerScope) InformerPolicySource {
+	tweak := func(options *metav1.ListOptions) {
+		options.LabelSelector = scope.LabelSelector
+	}
+
+	s := &scopedInformerPolicySource{
+		scope:   scope,
+		cluster: dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, metav1.NamespaceAll, tweak),
+		skipped: newPolicyIndexer(),
+	}
+	if len(scope.Namespaces) == 0 {
+		s.namespaced = append(s.namespaced, s.cluster)
+	}
+	// the policies of a namespace given twice would be listed twice by the merged indexer.
+	for _, namespace := range sets.NewString(scope.Namespaces...).List() {
+		s.namespaced = append(s.namespaced,
+			dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, tweak))
+	}
+
+	return s
+}
+
+func (s *scopedInformerPolicySource) Informers(resource schema.GroupVersionResource) []cache.SharedIndexInformer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if resource == ClusterOverridePolicyResource && s.scope.SkipClusterOverridePolicies {
+		return nil
+	}
+
+	factories := []dynamicinformer.DynamicSharedInformerFactory{s.cluster}
+	if resource == OverridePolicyResource {
+		factories = s.namespaced
+	}
+
+	informers := make([]cache.SharedIndexInformer, 0, len(factories))
+	for _, factory := range factories {
+		informers = append(informers, factory.ForResource(resource).Informer())
+	}
+	return informers
+}
+
+func (s *scopedInformerPolicySource) Indexer(resource schema.GroupVersionResource) cache.Indexer {
+	informers := s.Informers(resource)
+	if len(informers) == 0 {
+		return s.skipped
+	}
+
+	indexers := make([]cache.Indexer, 0, len(informers))
+	for _, informer := range informers {
+		indexers = append(indexers, informer.GetIndexer())
+	}
+	return NewMergedIndexer(indexers...)
+}
+
+func (s *scopedInformerPolicySource) HasSynced(resource schema.GroupVersionResource) bool {
+	for _, informer := range s.Informers(resource) {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *scopedInformerPolicySource) Start(stopCh <-chan struct{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.cluster.Start(stopCh)
+	for _, factory := range s.namespaced {
+		factory.Start(stopCh)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/util"
+)
+
+// MemoryPolicySource holds policies in memory. It is always synced.
+type MemoryPolicySource struct {
+	indexers map[schema.GroupVersionResource]cache.Indexer
+}
+
+var _ PolicySource = &MemoryPolicySource{}
+
+// NewMemoryPolicySource returns a MemoryPolicySource holding the given policies.
+// A policy is an *OverridePolicy, *ClusterOverridePolicy, *ClusterValidatePolicy or an *unstructured.Unstructured of them.
+func NewMemoryPolicySource(policies ...interface{}) (*MemoryPolicySource, error) {
+	s := &MemoryPolicySource{indexers: make(map[schema.GroupVersionResource]cache.Indexer, len(policyResources))}
+	for _, resource := range policyResources {
+		s.indexers[resource] = newPolicyIndexer()
+	}
+
+	if err := s.Add(policies...); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *MemoryPolicySource) Indexer(resource schema.GroupVersionResource) cache.Indexer {
+	if indexer, ok := s.indexers[resource]; ok {
+		return indexer
+	}
+
+	return newPolicyIndexer()
+}
+
+func (s *MemoryPolicySource) HasSynced(_ schema.GroupVersionResource) bool {
+	return true
+}
+
+func (s *MemoryPolicySource) Start(_ <-chan struct{}) error {
+	return nil
+}
+
+// Add adds the given policies, or updates them if they exist.
+func (s *MemoryPolicySource) Add(policies ...interface{}) error {
+	objs, err := toPolicyObjects(policies)
+	if err != nil {
+		return err
+	}
+
+	for resource, list := range objs {
+		for _, obj := range list {
+			if err = s.indexers[resource].Update(obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Delete deletes the given policies.
+func (s *MemoryPolicySource) Delete(policies ...interface{}) error {
+	objs, err := toPolicyObjects(policies)
+	if err != nil {
+		return err
+	}
+
+	for resource, list := range objs {
+		for _, obj := range list {
+			if err = s.indexers[resource].Delete(obj); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Replace replaces all the policies with the given ones.
+func (s *MemoryPolicySource) Replace(policies ...interface{}) error {
+	objs, err := toPolicyObjects(policies)
+	if err != nil {
+		return err
+	}
+
+	for resource, indexer := range s.indexers {
+		if err = indexer.Replace(objs[resource], ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// toPolicyObjects converts policies to unstructured objects grouped by resource.
+func toPolicyObjects(policies []interface{}) (map[schema.GroupVersionResource][]interface{}, error) {
+	objs := make(map[schema.GroupVersionResource][]interface{})
+	for _, policy := range policies {
+		obj, err := toPolicyObject(policy)
+		if err != nil {
+			return nil, err
+		}
+
+		resource, err := policyResourceOf(obj)
+		if err != nil {
+			return nil, err
+		}
+
+		objs[resource] = append(objs[resource], obj)
+	}
+
+	return objs, nil
+}
+
+func toPolicyObject(policy interface{}) (*unstructured.Unstructured, error) {
+	var kind string
+	switch p := policy.(type) {
+	case *unstructured.Unstructured:
+		return p.DeepCopy(), nil
+	case *policyv1alpha1.OverridePolicy:
+		kind = "OverridePolicy"
+	case *policyv1alpha1.ClusterOverridePolicy:
+		kind = "ClusterOverridePolicy"
+	case *policyv1alpha1.ClusterValidatePolicy:
+		kind = "ClusterValidatePolicy"
+	default:
+		return nil, fmt.Errorf("unsupported policy type %T", policy)
+	}
+
+	obj, err := util.ToUnstructured(policy)
+	if err != nil {
+		return nil, err
+	}
+	obj.SetGroupVersionKind(policyv1alpha1.SchemeGroupVersion.WithKind(kind))
+
+	return obj, nil
+}
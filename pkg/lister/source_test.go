@@ -0,0 +1,345 @@
+/*
+Copyright 2022 by k-cloud-labs org.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package lister
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+const policiesYAML = `
+apiVersion: policy.kcloudlabs.io/v1alpha1
+kind: ClusterOverridePolicy
+metadata:
+  name: cop
+---
+apiVersion: policy.kcloudlabs.io/v1alpha1
+kind: OverridePolicy
+metadata:
+  name: op
+  namespace: default
+`
+
+func TestNewMemoryPolicySource(t *testing.T) {
+	source, err := NewMemoryPolicySource(
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}},
+		&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "default"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPolicies(t, source, []string{"cop"}, []string{"op"})
+
+	if err = source.Replace(&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop2"}}); err != nil {
+		t.Fatal(err)
+	}
+	assertPolicies(t, source, []string{"cop2"}, nil)
+
+	if _, err = NewMemoryPolicySource(&metav1.Status{}); err == nil {
+		t.Errorf("NewMemoryPolicySource() with unsupported type should fail")
+	}
+}
+
+func TestNewFSPolicySource(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr bool
+		cops    []string
+		ops     []string
+	}{
+		{
+			name: "multiple policies in subdirectory",
+			fsys: fstest.MapFS{
+				"policies/all.yaml": {Data: []byte(policiesYAML)},
+				"README.md":         {Data: []byte("not a policy")},
+			},
+			cops: []string{"cop"},
+			ops:  []string{"op"},
+		},
+		{
+			name: "json",
+			fsys: fstest.MapFS{
+				"cop.json": {Data: []byte(`{"apiVersion":"policy.kcloudlabs.io/v1alpha1","kind":"ClusterOverridePolicy","metadata":{"name":"cop"}}`)},
+			},
+			cops: []string{"cop"},
+		},
+		{
+			name: "unsupported kind",
+			fsys: fstest.MapFS{
+				"cm.yaml": {Data: []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: cm\n")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source, err := NewFSPolicySource(tt.fsys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewFSPolicySource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			assertPolicies(t, source, tt.cops, tt.ops)
+		})
+	}
+}
+
+func TestFilePolicySource_Reload(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "policies.yaml")
+	if err := os.WriteFile(file, []byte(policiesYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewFilePolicySource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPolicies(t, source, []string{"cop"}, []string{"op"})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err = source.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// a broken file keeps the loaded policies.
+	if err = os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("kind: ConfigMap"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * reloadDelay)
+	assertPolicies(t, source, []string{"cop"}, []string{"op"})
+
+	if err = os.Remove(filepath.Join(dir, "broken.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(file, []byte("apiVersion: policy.kcloudlabs.io/v1alpha1\nkind: ClusterOverridePolicy\nmetadata:\n  name: cop2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	err = wait.PollImmediate(reloadDelay, 5*time.Second, func() (bool, error) {
+		cops, err := NewClusterOverridePolicyLister(source).List(labels.Everything())
+		return err == nil && len(cops) == 1 && cops[0].Name == "cop2", nil
+	})
+	if err != nil {
+		t.Fatalf("policies are not reloaded: %v", err)
+	}
+	assertPolicies(t, source, []string{"cop2"}, nil)
+}
+
+func TestFilePolicySource_ReloadAtomicWriter(t *testing.T) {
+	// the layout of a ConfigMap volume written by the atomic writer of kubelet.
+	dir := t.TempDir()
+	writeData := func(version, content string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "policies.yaml"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeData("..2022_01_01_00_00_00.1", policiesYAML)
+	if err := os.Symlink(filepath.Join("..data", "policies.yaml"), filepath.Join(dir, "policies.yaml")); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewFilePolicySource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertPolicies(t, source, []string{"cop"}, []string{"op"})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err = source.Start(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// no event is sent for policies.yaml when the ..data symlink is swapped.
+	writeData("..2022_01_01_00_00_00.2", "apiVersion: policy.kcloudlabs.io/v1alpha1\nkind: ClusterOverridePolicy\nmetadata:\n  name: cop2\n")
+	if err = os.RemoveAll(filepath.Join(dir, "..2022_01_01_00_00_00.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = wait.PollImmediate(reloadDelay, 5*time.Second, func() (bool, error) {
+		cops, err := NewClusterOverridePolicyLister(source).List(labels.Everything())
+		return err == nil && len(cops) == 1 && cops[0].Name == "cop2", nil
+	})
+	if err != nil {
+		t.Fatalf("policies are not reloaded: %v", err)
+	}
+	assertPolicies(t, source, []string{"cop2"}, nil)
+}
+
+func TestNewScopedInformerPolicySource(t *testing.T) {
+	newPolicy := func(kind, namespace, name, client string) runtime.Object {
+		obj := &unstructured.Unstructured{}
+		obj.SetGroupVersionKind(policyv1alpha1.SchemeGroupVersion.WithKind(kind))
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		obj.SetLabels(map[string]string{"pidalio.io/client": client})
+		return obj
+	}
+
+	tests := []struct {
+		name   string
+		scope  InformerScope
+		cops   []string
+		ops    []string
+		allOps []string
+	}{
+		{
+			name:   "cluster-wide",
+			cops:   []string{"billing", "shop"},
+			ops:    []string{"billing", "shop"},
+			allOps: []string{"billing", "billing", "shop", "shop"},
+		},
+		{
+			name:   "namespaces",
+			scope:  InformerScope{Namespaces: []string{"default", "team-a"}},
+			cops:   []string{"billing", "shop"},
+			ops:    []string{"billing", "shop"},
+			allOps: []string{"billing", "shop", "billing"},
+		},
+		{
+			name:   "duplicate namespaces",
+			scope:  InformerScope{Namespaces: []string{"team-a", "default", "team-a"}},
+			cops:   []string{"billing", "shop"},
+			ops:    []string{"billing", "shop"},
+			allOps: []string{"billing", "shop", "billing"},
+		},
+		{
+			name:   "label selector",
+			scope:  InformerScope{LabelSelector: "pidalio.io/client=billing"},
+			cops:   []string{"billing"},
+			ops:    []string{"billing"},
+			allOps: []string{"billing", "billing"},
+		},
+		{
+			name:   "skip cluster override policies",
+			scope:  InformerScope{Namespaces: []string{"team-b"}, SkipClusterOverridePolicies: true},
+			allOps: []string{"shop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{
+					OverridePolicyResource:        "OverridePolicyList",
+					ClusterOverridePolicyResource: "ClusterOverridePolicyList",
+				},
+				newPolicy("ClusterOverridePolicy", "", "billing", "billing"),
+				newPolicy("ClusterOverridePolicy", "", "shop", "shop"),
+				newPolicy("OverridePolicy", "default", "billing", "billing"),
+				newPolicy("OverridePolicy", "default", "shop", "shop"),
+				newPolicy("OverridePolicy", "team-a", "billing", "billing"),
+				newPolicy("OverridePolicy", "team-b", "shop", "shop"),
+			)
+
+			source := NewScopedInformerPolicySource(client, tt.scope)
+			copLister := NewClusterOverridePolicyLister(source)
+			opLister := NewOverridePolicyLister(source)
+
+			stopCh := make(chan struct{})
+			defer close(stopCh)
+			if err := source.Start(stopCh); err != nil {
+				t.Fatal(err)
+			}
+			if !cache.WaitForCacheSync(stopCh, func() bool {
+				return source.HasSynced(OverridePolicyResource) && source.HasSynced(ClusterOverridePolicyResource)
+			}) {
+				t.Fatal("policies are not synced")
+			}
+
+			assertPolicies(t, source, tt.cops, tt.ops)
+
+			ops, err := opLister.List(labels.Everything())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != len(tt.allOps) {
+				t.Fatalf("got %d override policies in all namespaces, want %v", len(ops), tt.allOps)
+			}
+
+			for _, name := range tt.ops {
+				if _, err = opLister.OverridePolicies("default").Get(name); err != nil {
+					t.Errorf("Get() error = %v", err)
+				}
+			}
+			if _, err = copLister.Get("billing"); (err == nil) != (len(tt.cops) != 0) {
+				t.Errorf("Get() error = %v, want cluster override policies %v", err, tt.cops)
+			}
+		})
+	}
+}
+
+func assertPolicies(t *testing.T, source PolicySource, wantCops, wantOps []string) {
+	t.Helper()
+
+	cops, err := NewClusterOverridePolicyLister(source).List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cops) != len(wantCops) {
+		t.Fatalf("got %d cluster override policies, want %v", len(cops), wantCops)
+	}
+	// indexers list policies in no particular order.
+	sort.Slice(cops, func(i, j int) bool { return cops[i].Name < cops[j].Name })
+	for i, cop := range cops {
+		if cop.Name != wantCops[i] {
+			t.Errorf("got cluster override policy %s, want %s", cop.Name, wantCops[i])
+		}
+	}
+
+	ops, err := NewOverridePolicyLister(source).OverridePolicies("default").List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != len(wantOps) {
+		t.Fatalf("got %d override policies, want %v", len(ops), wantOps)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Name < ops[j].Name })
+	for i, op := range ops {
+		if op.Name != wantOps[i] {
+			t.Errorf("got override policy %s, want %s", op.Name, wantOps[i])
+		}
+	}
+}
@@ -0,0 +1,553 @@
+package pidalio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+)
+
+// ReconcileStatusAnnotation on a (Cluster)OverridePolicy records the progress of reconciling the objects it
+// selects, it is a json encoded ReconcileStatus.
+const ReconcileStatusAnnotation = "policy.kcloudlabs.io/reconcile-status"
+
+const (
+	defaultReconcileQPS        = 5
+	defaultReconcileBurst      = 10
+	defaultReconcileMaxObjects = 500
+
+	defaultReconcileLeaseNamespace = metav1.NamespaceDefault
+	defaultReconcileLeaseName      = "pidalio-reconcile"
+
+	// reconcileProgressInterval is the number of objects reconciled between progress reports.
+	reconcileProgressInterval = 50
+	// reconcileMaxRetries is the number of retries of a policy failing to list its objects.
+	reconcileMaxRetries = 5
+)
+
+// phases of reconciling a policy.
+const (
+	ReconcileRunning   = "Running"
+	ReconcileCompleted = "Completed"
+	ReconcileAborted   = "Aborted"
+)
+
+// ReconcileOptions configures reconciling existing objects when a (Cluster)OverridePolicy is added or its spec
+// changes: the objects selected by the resource selectors of the policy are updated through the transport, so all
+// the policies are applied on them again. Enable IdempotentOverrides too unless every overrider is idempotent.
+// Objects are listed by the dynamic resource lister, and only the process holding the lease reconciles objects.
+// When a process starts leading, it reconciles the policies whose current generation is not reconciled yet, so the
+// policies changed while no process was leading are not missed.
+type ReconcileOptions struct {
+	// Enabled enables reconciling objects, it is disabled by default. Policies without a reconcile status are
+	// reconciled once the first time a process starts leading, so enabling it updates the objects selected by every
+	// existing policy, see DryRun.
+	Enabled bool
+	// LeaseNamespace is the namespace of the lease to elect the process reconciling objects, defaults to default.
+	LeaseNamespace string
+	// LeaseName is the name of the lease to elect the process reconciling objects, defaults to pidalio-reconcile.
+	LeaseName string
+	// Identity is the identity of this process in the election, defaults to the hostname.
+	Identity string
+	// QPS and Burst limit the rate of updates, default to 5 and 10.
+	QPS   float32
+	Burst int
+	// DryRun sends updates with dryRun=All, so ReconcileStatus reports the objects which would change.
+	DryRun bool
+	// MaxObjects is the maximum number of objects reconciled for a policy, defaults to 500. A policy selecting more
+	// objects is aborted without updating any of them.
+	MaxObjects int
+}
+
+// ReconcileStatus is the progress of reconciling the objects selected by a policy.
+type ReconcileStatus struct {
+	// Phase is Running, Completed or Aborted.
+	Phase  string `json:"phase"`
+	DryRun bool   `json:"dryRun,omitempty"`
+	// Generation is the generation of the policy reconciled.
+	Generation int64 `json:"generation,omitempty"`
+	// Matched is the number of objects selected by the policy.
+	Matched int `json:"matched"`
+	// Updated is the number of objects changed, or which would change in dry run.
+	Updated   int `json:"updated"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+	// Message is the reason a policy is aborted.
+	Message string      `json:"message,omitempty"`
+	Time    metav1.Time `json:"time"`
+}
+
+// policyReconciler updates the objects selected by added or changed policies one policy at a time.
+type policyReconciler struct {
+	queue     workqueue.RateLimitingInterface
+	copLister v1alpha1.ClusterOverridePolicyLister
+	opLister  v1alpha1.OverridePolicyLister
+	mapper    meta.RESTMapper
+	// listers lists the objects selected by policies, it is the dynamic resource lister.
+	listers resourceListers
+	// reader gets objects and records the status of policies without the transport.
+	reader dynamic.Interface
+	// writer updates objects through the transport.
+	writer     dynamic.Interface
+	dryRun     bool
+	maxObjects int
+	elector    *leaseElector
+	// isLeader returns true if this process reconciles objects.
+	isLeader func() bool
+	// policiesSynced returns true if the policy listers are synced.
+	policiesSynced cache.InformerSynced
+}
+
+func (s *setupManager) setupReconciler(cfg *rest.Config, opts ReconcileOptions) error {
+	if opts.QPS == 0 {
+		opts.QPS = defaultReconcileQPS
+	}
+	if opts.Burst == 0 {
+		opts.Burst = defaultReconcileBurst
+	}
+	if opts.MaxObjects == 0 {
+		opts.MaxObjects = defaultReconcileMaxObjects
+	}
+	if len(opts.LeaseNamespace) == 0 {
+		opts.LeaseNamespace = defaultReconcileLeaseNamespace
+	}
+	if len(opts.LeaseName) == 0 {
+		opts.LeaseName = defaultReconcileLeaseName
+	}
+
+	listers, ok := s.drLister.(resourceListers)
+	if !ok {
+		return fmt.Errorf("dynamic resource lister %T can not list objects", s.drLister)
+	}
+
+	// leases, reads and statuses are not sent through the transport.
+	kubeClient, err := kubernetes.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+	reader, err := dynamic.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+
+	writerConfig := rest.CopyConfig(cfg)
+	writerConfig.QPS = opts.QPS
+	writerConfig.Burst = opts.Burst
+	writer, err := dynamic.NewForConfig(writerConfig)
+	if err != nil {
+		return err
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+
+	r := &policyReconciler{
+		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "pidalio-reconciler"),
+		copLister:  s.copLister,
+		opLister:   s.opLister,
+		mapper:     restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		listers:    listers,
+		reader:     reader,
+		writer:     writer,
+		dryRun:     opts.DryRun,
+		maxObjects: opts.MaxObjects,
+		policiesSynced: func() bool {
+			return s.policySource.HasSynced(opGVR) && s.policySource.HasSynced(copGVR)
+		},
+	}
+	r.elector, err = newLeaseElector("pidalio-reconcile", kubeClient, opts.LeaseNamespace, opts.LeaseName,
+		opts.Identity, r.enqueueUnreconciled)
+	if err != nil {
+		return err
+	}
+	r.isLeader = r.elector.isLeader
+	s.reconciler = r
+
+	s.addReconcilerEventHandlers(opGVR)
+	s.addReconcilerEventHandlers(copGVR)
+	return nil
+}
+
+// addReconcilerEventHandlers enqueues the policies added after the informer is synced, and the policies whose
+// spec changes. Events received while this process is not leading are dropped, the policies are enqueued by
+// enqueueUnreconciled once it starts leading.
+func (s *setupManager) addReconcilerEventHandlers(gvr schema.GroupVersionResource) {
+	for _, informer := range s.policyInformers.Informers(gvr) {
+		informer := informer
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				// policies listed when the informer starts are not changed.
+				if informer.HasSynced() {
+					s.reconciler.enqueue(gvr, obj)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if !reflect.DeepEqual(oldObj.(*unstructured.Unstructured).Object["spec"], newObj.(*unstructured.Unstructured).Object["spec"]) {
+					s.reconciler.enqueue(gvr, newObj)
+				}
+			},
+		})
+	}
+}
+
+func (r *policyReconciler) enqueue(gvr schema.GroupVersionResource, obj interface{}) {
+	if !r.isLeader() {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	r.queue.Add(gvr.Resource + "/" + key)
+}
+
+// enqueueUnreconciled enqueues the policies whose current generation is not reconciled, it is called when this
+// process starts leading.
+func (r *policyReconciler) enqueueUnreconciled(ctx context.Context) {
+	if !cache.WaitForCacheSync(ctx.Done(), r.policiesSynced) {
+		return
+	}
+
+	ops, err := r.opLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "failed to list override policies.")
+	}
+	for _, op := range ops {
+		if needsReconcile(op) {
+			r.enqueue(opGVR, op)
+		}
+	}
+
+	cops, err := r.copLister.List(labels.Everything())
+	if err != nil {
+		klog.ErrorS(err, "failed to list cluster override policies.")
+	}
+	for _, cop := range cops {
+		if needsReconcile(cop) {
+			r.enqueue(copGVR, cop)
+		}
+	}
+}
+
+// needsReconcile returns true if the policy has no reconcile status of its current generation, or reconciling it
+// was interrupted.
+func needsReconcile(policy metav1.Object) bool {
+	status := ReconcileStatus{}
+	if err := json.Unmarshal([]byte(policy.GetAnnotations()[ReconcileStatusAnnotation]), &status); err != nil {
+		return true
+	}
+	return status.Generation != policy.GetGeneration() || status.Phase == ReconcileRunning
+}
+
+// run takes part in the election and reconciles the queued policies until ctx is done.
+func (r *policyReconciler) run(ctx context.Context) {
+	go r.elector.run(ctx)
+	go func() {
+		<-ctx.Done()
+		r.queue.ShutDown()
+	}()
+
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		for r.processNext(ctx) {
+		}
+	}, time.Second)
+}
+
+func (r *policyReconciler) processNext(ctx context.Context) bool {
+	item, shutdown := r.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer r.queue.Done(item)
+
+	if err := r.reconcile(ctx, item.(string)); err != nil {
+		if r.queue.NumRequeues(item) < reconcileMaxRetries {
+			klog.ErrorS(err, "Failed to reconcile policy, retry later.", "policy", item)
+			r.queue.AddRateLimited(item)
+			return true
+		}
+		klog.ErrorS(err, "Failed to reconcile policy, give up.", "policy", item)
+	}
+
+	r.queue.Forget(item)
+	return true
+}
+
+// reconcile updates the objects selected by the policy with key resource/[namespace/]name. It returns an error if
+// the objects can not be listed, failing to update objects is reported by the status of the policy. Nothing is done
+// if this process is not leading anymore.
+func (r *policyReconciler) reconcile(ctx context.Context, key string) error {
+	if !r.isLeader() {
+		return nil
+	}
+
+	resource, policyKey := key[:strings.Index(key, "/")], key[strings.Index(key, "/")+1:]
+	namespace, name, err := cache.SplitMetaNamespaceKey(policyKey)
+	if err != nil {
+		return err
+	}
+
+	var (
+		gvr        schema.GroupVersionResource
+		generation int64
+		selectors  []policyv1alpha1.ResourceSelector
+	)
+	switch resource {
+	case copGVR.Resource:
+		cop, err := r.copLister.Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		gvr, generation, selectors = copGVR, cop.Generation, cop.Spec.ResourceSelectors
+	case opGVR.Resource:
+		op, err := r.opLister.OverridePolicies(namespace).Get(name)
+		if apierrors.IsNotFound(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// an OverridePolicy only selects objects in its namespace.
+		gvr, generation, selectors = opGVR, op.Generation, append([]policyv1alpha1.ResourceSelector(nil), op.Spec.ResourceSelectors...)
+		for i := range selectors {
+			selectors[i].Namespace = namespace
+		}
+	default:
+		return fmt.Errorf("unknown policy resource %q", resource)
+	}
+
+	status := &ReconcileStatus{Phase: ReconcileRunning, DryRun: r.dryRun, Generation: generation}
+	report := func() {
+		status.Time = metav1.Now()
+		if err := r.setStatus(ctx, gvr, namespace, name, status); err != nil {
+			klog.ErrorS(err, "Failed to record reconcile status.", "policy", policyKey)
+		}
+	}
+
+	if len(selectors) == 0 {
+		status.Phase, status.Message = ReconcileAborted, "the policy has no resource selector"
+		report()
+		return nil
+	}
+
+	objects, mappings, err := r.listSelected(selectors)
+	if err != nil {
+		return err
+	}
+	status.Matched = len(objects)
+	if len(objects) > r.maxObjects {
+		status.Phase = ReconcileAborted
+		status.Message = fmt.Sprintf("the policy selects more than %d objects", r.maxObjects)
+		report()
+		return nil
+	}
+	klog.InfoS("reconcile objects selected by policy.", "policy", policyKey, "objects", len(objects), "dryRun", r.dryRun)
+	report()
+
+	for i, obj := range objects {
+		changed, err := r.update(ctx, mappings[i], obj)
+		switch {
+		case err != nil:
+			klog.ErrorS(err, "Failed to reconcile object.", "policy", policyKey, "resource", klog.KObj(obj))
+			status.Failed++
+		case changed:
+			status.Updated++
+		default:
+			status.Unchanged++
+		}
+
+		if (i+1)%reconcileProgressInterval == 0 {
+			report()
+		}
+	}
+
+	status.Phase = ReconcileCompleted
+	report()
+	return nil
+}
+
+// listSelected lists the objects selected by selectors together with their resources from the dynamic resource
+// lister, at most maxObjects+1 objects.
+func (r *policyReconciler) listSelected(selectors []policyv1alpha1.ResourceSelector) (
+	[]*unstructured.Unstructured, []schema.GroupVersionResource, error) {
+	var (
+		objects []*unstructured.Unstructured
+		gvrs    []schema.GroupVersionResource
+		seen    = sets.NewString()
+	)
+	for _, selector := range selectors {
+		gv, err := schema.ParseGroupVersion(selector.APIVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		mapping, err := r.mapper.RESTMapping(gv.WithKind(selector.Kind).GroupKind(), gv.Version)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		lister, err := r.lister(mapping.Resource)
+		if err != nil {
+			return nil, nil, err
+		}
+		var items []runtime.Object
+		if len(selector.Name) != 0 {
+			var obj runtime.Object
+			if len(selector.Namespace) != 0 {
+				obj, err = lister.ByNamespace(selector.Namespace).Get(selector.Name)
+			} else {
+				obj, err = lister.Get(selector.Name)
+			}
+			if apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, obj)
+		} else {
+			labelSelector := labels.Everything()
+			if selector.LabelSelector != nil {
+				if labelSelector, err = metav1.LabelSelectorAsSelector(selector.LabelSelector); err != nil {
+					return nil, nil, err
+				}
+			}
+			if len(selector.Namespace) != 0 {
+				items, err = lister.ByNamespace(selector.Namespace).List(labelSelector)
+			} else {
+				items, err = lister.List(labelSelector)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for _, item := range items {
+			obj, ok := item.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil, fmt.Errorf("unexpected object type %T of %s", item, mapping.Resource)
+			}
+			if seen.Has(string(obj.GetUID())) {
+				continue
+			}
+			seen.Insert(string(obj.GetUID()))
+			objects = append(objects, obj.DeepCopy())
+			gvrs = append(gvrs, mapping.Resource)
+			if len(objects) > r.maxObjects {
+				return objects, gvrs, nil
+			}
+		}
+	}
+
+	return objects, gvrs, nil
+}
+
+// lister returns the synced lister of gvr, gvr is registered to the dynamic resource lister the first time.
+func (r *policyReconciler) lister(gvr schema.GroupVersionResource) (cache.GenericLister, error) {
+	if _, _, err := r.listers.GetResourceLister(gvr); err != nil {
+		if err = r.listers.RegisterNewResource(true, gvr); err != nil {
+			return nil, err
+		}
+	}
+
+	lister, synced, err := r.listers.GetResourceLister(gvr)
+	if err != nil {
+		return nil, err
+	}
+	if !synced() {
+		return nil, fmt.Errorf("objects of %s are not synced", gvr)
+	}
+	return lister, nil
+}
+
+// update sends obj through the transport and returns true if policies change it.
+// It is retried with the latest object on conflict.
+func (r *policyReconciler) update(ctx context.Context, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) (bool, error) {
+	opts := metav1.UpdateOptions{}
+	if r.dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	var changed bool
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		updated, err := r.writer.Resource(gvr).Namespace(obj.GetNamespace()).Update(ctx, obj.DeepCopy(), opts)
+		if apierrors.IsConflict(err) {
+			latest, getErr := r.reader.Resource(gvr).Namespace(obj.GetNamespace()).Get(ctx, obj.GetName(), metav1.GetOptions{})
+			if getErr != nil {
+				return getErr
+			}
+			obj = latest
+		}
+		if err != nil {
+			return err
+		}
+
+		changed = objectChanged(obj, updated)
+		return nil
+	})
+
+	return changed, err
+}
+
+// objectChanged returns true if after differs from before besides the metadata maintained by the apiserver.
+func objectChanged(before, after *unstructured.Unstructured) bool {
+	strip := func(obj *unstructured.Unstructured) map[string]interface{} {
+		obj = obj.DeepCopy()
+		obj.SetResourceVersion("")
+		obj.SetManagedFields(nil)
+		obj.SetGeneration(0)
+		return obj.Object
+	}
+
+	return !reflect.DeepEqual(strip(before), strip(after))
+}
+
+// setStatus records status in annotation ReconcileStatusAnnotation of a policy.
+func (r *policyReconciler) setStatus(ctx context.Context, gvr schema.GroupVersionResource, namespace, name string, status *ReconcileStatus) error {
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				ReconcileStatusAnnotation: string(statusBytes),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.reader.Resource(gvr).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,278 @@
+package pidalio
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+func TestPolicyReconciler_reconcile(t *testing.T) {
+	configMapGVR := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	newConfigMap := func(namespace, name string, labels map[string]string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion("v1")
+		obj.SetKind("ConfigMap")
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		obj.SetUID(types.UID(namespace + "/" + name))
+		obj.SetLabels(labels)
+		return obj
+	}
+	selectWeb := []policyv1alpha1.ResourceSelector{{
+		APIVersion:    "v1",
+		Kind:          "ConfigMap",
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+	}}
+
+	tests := []struct {
+		name       string
+		policy     interface{}
+		key        string
+		dryRun     bool
+		maxObjects int
+		wantStatus ReconcileStatus
+		wantSpot   []string
+	}{
+		{
+			name: "completed",
+			policy: &policyv1alpha1.ClusterOverridePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "spot"},
+				Spec:       policyv1alpha1.OverridePolicySpec{ResourceSelectors: selectWeb},
+			},
+			key:        "clusteroverridepolicies/spot",
+			maxObjects: 10,
+			wantStatus: ReconcileStatus{Phase: ReconcileCompleted, Matched: 3, Updated: 2, Unchanged: 1},
+			wantSpot:   []string{"default/web", "default/spot", "other/web"},
+		},
+		{
+			name: "dry run",
+			policy: &policyv1alpha1.ClusterOverridePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "spot"},
+				Spec:       policyv1alpha1.OverridePolicySpec{ResourceSelectors: selectWeb},
+			},
+			key:        "clusteroverridepolicies/spot",
+			dryRun:     true,
+			maxObjects: 10,
+			wantStatus: ReconcileStatus{Phase: ReconcileCompleted, DryRun: true, Matched: 3, Updated: 2, Unchanged: 1},
+		},
+		{
+			name: "namespaced policy",
+			policy: &policyv1alpha1.OverridePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "spot", Namespace: "other"},
+				Spec:       policyv1alpha1.OverridePolicySpec{ResourceSelectors: selectWeb},
+			},
+			key:        "overridepolicies/other/spot",
+			maxObjects: 10,
+			wantStatus: ReconcileStatus{Phase: ReconcileCompleted, Matched: 1, Updated: 1},
+			wantSpot:   []string{"default/spot", "other/web"},
+		},
+		{
+			name: "too many objects",
+			policy: &policyv1alpha1.ClusterOverridePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "spot"},
+				Spec:       policyv1alpha1.OverridePolicySpec{ResourceSelectors: selectWeb},
+			},
+			key:        "clusteroverridepolicies/spot",
+			maxObjects: 2,
+			wantStatus: ReconcileStatus{Phase: ReconcileAborted, Matched: 3, Message: "the policy selects more than 2 objects"},
+			wantSpot:   []string{"default/spot"},
+		},
+		{
+			name:       "no resource selector",
+			policy:     &policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "spot"}},
+			key:        "clusteroverridepolicies/spot",
+			maxObjects: 10,
+			wantStatus: ReconcileStatus{Phase: ReconcileAborted, Message: "the policy has no resource selector"},
+			wantSpot:   []string{"default/spot"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accessor, err := meta.Accessor(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			accessor.SetGeneration(2)
+			source, err := lister.NewMemoryPolicySource(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			policyObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			policy := &unstructured.Unstructured{Object: policyObj}
+			policy.SetAPIVersion(policyv1alpha1.SchemeGroupVersion.String())
+			if _, ok := tt.policy.(*policyv1alpha1.OverridePolicy); ok {
+				policy.SetKind("OverridePolicy")
+			} else {
+				policy.SetKind("ClusterOverridePolicy")
+			}
+
+			configMaps := []runtime.Object{
+				newConfigMap("default", "web", map[string]string{"app": "web"}),
+				newConfigMap("default", "spot", map[string]string{"app": "web", "spot": "true"}),
+				newConfigMap("other", "web", map[string]string{"app": "web"}),
+				newConfigMap("default", "db", map[string]string{"app": "db"}),
+			}
+			// objects are listed from the dynamic resource lister.
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, obj := range configMaps {
+				if err = indexer.Add(obj.DeepCopyObject()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			listers := &fakeResourceListers{indexers: map[schema.GroupVersionResource]cache.Indexer{configMapGVR: indexer}}
+
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{
+					configMapGVR: "ConfigMapList",
+					opGVR:        "OverridePolicyList",
+					copGVR:       "ClusterOverridePolicyList",
+				},
+				append(configMaps, policy)...,
+			)
+			// the writer sends objects through the transport, which applies the policy.
+			client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+				obj := action.(clienttesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+				labels := obj.GetLabels()
+				labels["spot"] = "true"
+				obj.SetLabels(labels)
+				// the fake client does not support dry run.
+				return tt.dryRun, obj, nil
+			})
+
+			mapper := meta.NewDefaultRESTMapper(nil)
+			mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+
+			r := &policyReconciler{
+				queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+				copLister:  lister.NewClusterOverridePolicyLister(source),
+				opLister:   lister.NewOverridePolicyLister(source),
+				mapper:     mapper,
+				listers:    listers,
+				reader:     client,
+				writer:     client,
+				dryRun:     tt.dryRun,
+				maxObjects: tt.maxObjects,
+				isLeader:   func() bool { return true },
+			}
+			if err = r.reconcile(context.Background(), tt.key); err != nil {
+				t.Fatalf("reconcile() error = %v", err)
+			}
+
+			gvr := copGVR
+			if policy.GetKind() == "OverridePolicy" {
+				gvr = opGVR
+			}
+			got, err := client.Resource(gvr).Namespace(policy.GetNamespace()).Get(context.Background(), policy.GetName(), metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := ReconcileStatus{}
+			if err = json.Unmarshal([]byte(got.GetAnnotations()[ReconcileStatusAnnotation]), &status); err != nil {
+				t.Fatalf("invalid reconcile status %q: %v", got.GetAnnotations()[ReconcileStatusAnnotation], err)
+			}
+			status.Time = metav1.Time{}
+			tt.wantStatus.Generation = 2
+			if status != tt.wantStatus {
+				t.Errorf("reconcile status = %+v, want %+v", status, tt.wantStatus)
+			}
+
+			if tt.dryRun {
+				return
+			}
+			list, err := client.Resource(configMapGVR).List(context.Background(), metav1.ListOptions{LabelSelector: "spot=true"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Items) != len(tt.wantSpot) {
+				t.Errorf("objects with label spot = %d, want %v", len(list.Items), tt.wantSpot)
+			}
+		})
+	}
+}
+
+func TestPolicyReconciler_reconcileNotLeading(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	r := &policyReconciler{
+		reader:   client,
+		writer:   client,
+		isLeader: func() bool { return false },
+	}
+	if err := r.reconcile(context.Background(), "clusteroverridepolicies/spot"); err != nil {
+		t.Errorf("reconcile() error = %v, want nil", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("reconcile() sent %v, want nothing when not leading", actions)
+	}
+}
+
+func TestPolicyReconciler_enqueueUnreconciled(t *testing.T) {
+	newStatus := func(phase string, generation int64) map[string]string {
+		status, err := json.Marshal(ReconcileStatus{Phase: phase, Generation: generation})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return map[string]string{ReconcileStatusAnnotation: string(status)}
+	}
+	newPolicy := func(name string, generation int64, annotations map[string]string) *policyv1alpha1.ClusterOverridePolicy {
+		return &policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Generation:  generation,
+			Annotations: annotations,
+		}}
+	}
+
+	source, err := lister.NewMemoryPolicySource(
+		newPolicy("new", 1, nil),
+		newPolicy("changed", 3, newStatus(ReconcileCompleted, 2)),
+		newPolicy("interrupted", 2, newStatus(ReconcileRunning, 2)),
+		newPolicy("completed", 2, newStatus(ReconcileCompleted, 2)),
+		newPolicy("aborted", 2, newStatus(ReconcileAborted, 2)),
+		&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "default", Generation: 1}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &policyReconciler{
+		queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		copLister:      lister.NewClusterOverridePolicyLister(source),
+		opLister:       lister.NewOverridePolicyLister(source),
+		isLeader:       func() bool { return true },
+		policiesSynced: func() bool { return true },
+	}
+	r.enqueueUnreconciled(context.Background())
+
+	got := sets.NewString()
+	for r.queue.Len() > 0 {
+		item, _ := r.queue.Get()
+		got.Insert(item.(string))
+		r.queue.Done(item)
+	}
+	want := sets.NewString(
+		"clusteroverridepolicies/new",
+		"clusteroverridepolicies/changed",
+		"clusteroverridepolicies/interrupted",
+		"overridepolicies/default/new",
+	)
+	if !got.Equal(want) {
+		t.Errorf("enqueueUnreconciled() enqueued %v, want %v", got.List(), want.List())
+	}
+}
@@ -0,0 +1,209 @@
+package pidalio
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/rest"
+)
+
+// RequestInfo holds information parsed from the url of a request sent to the apiserver.
+// It is a simplified version of the RequestInfo built by the apiserver's RequestInfoFactory.
+type RequestInfo struct {
+	// IsResourceRequest indicates whether the request is for an API resource or a non-resource path like /version.
+	IsResourceRequest bool
+	// Path is the url path of the request.
+	Path string
+	// Verb is the kube verb associated with the request, e.g. create, update, patch.
+	Verb string
+
+	APIPrefix   string
+	APIGroup    string
+	APIVersion  string
+	Namespace   string
+	Resource    string
+	Subresource string
+	Name        string
+	// Parts are the path parts for the request, always starting with /{resource}/{name}.
+	Parts []string
+}
+
+var (
+	apiPrefixes          = sets.NewString("api", "apis")
+	grouplessAPIPrefixes = sets.NewString("api")
+	// namespaceSubresources are subresources of a namespace object, not namespaced resources.
+	namespaceSubresources = sets.NewString("status", "finalize")
+	// virtualResources are resources which are never persisted, so they are never mutated.
+	virtualResources = sets.NewString(
+		"/bindings",
+		"authentication.k8s.io/tokenreviews",
+		"authorization.k8s.io/subjectaccessreviews",
+		"authorization.k8s.io/selfsubjectaccessreviews",
+		"authorization.k8s.io/localsubjectaccessreviews",
+		"authorization.k8s.io/selfsubjectrulesreviews",
+	)
+	// nonObjectKinds are kinds of request bodies which are options rather than objects.
+	nonObjectKinds = sets.NewString("DeleteOptions", "CreateOptions", "UpdateOptions", "PatchOptions")
+)
+
+// ParseRequestInfo returns the information from the http request.
+// Valid inputs look like:
+//
+//	/apis/{api-group}/{version}/namespaces/{namespace}/{resource}/{resourceName}/{subresource}
+//	/api/{version}/{resource}/{resourceName}
+//
+// Any other path is returned with IsResourceRequest false.
+func ParseRequestInfo(req *http.Request) *RequestInfo {
+	return parseRequestInfo(req, "")
+}
+
+// parseRequestInfo returns the information from the http request whose path starts with prefix, see requestPathPrefix.
+func parseRequestInfo(req *http.Request, prefix string) *RequestInfo {
+	info := &RequestInfo{
+		Path: req.URL.Path,
+		Verb: strings.ToLower(req.Method),
+	}
+
+	path := req.URL.Path
+	if len(prefix) != 0 && (path == prefix || strings.HasPrefix(path, prefix+"/")) {
+		path = strings.TrimPrefix(path, prefix)
+	}
+
+	currentParts := splitPath(path)
+	if len(currentParts) < 3 {
+		// return a non-resource request
+		return info
+	}
+
+	if !apiPrefixes.Has(currentParts[0]) {
+		return info
+	}
+	info.APIPrefix = currentParts[0]
+	currentParts = currentParts[1:]
+
+	if !grouplessAPIPrefixes.Has(info.APIPrefix) {
+		// one part (APIPrefix) has already been consumed, so this is actually "do we have four parts?"
+		if len(currentParts) < 3 {
+			return info
+		}
+
+		info.APIGroup = currentParts[0]
+		currentParts = currentParts[1:]
+	}
+
+	info.IsResourceRequest = true
+	info.APIVersion = currentParts[0]
+	currentParts = currentParts[1:]
+
+	switch req.Method {
+	case http.MethodPost:
+		info.Verb = "create"
+	case http.MethodGet, http.MethodHead:
+		info.Verb = "get"
+	case http.MethodPut:
+		info.Verb = "update"
+	case http.MethodPatch:
+		info.Verb = "patch"
+	case http.MethodDelete:
+		info.Verb = "delete"
+	}
+
+	// URL forms: /namespaces/{namespace}/{kind}/*, where parts are adjusted to be relative to kind
+	if currentParts[0] == "namespaces" {
+		if len(currentParts) > 1 {
+			info.Namespace = currentParts[1]
+
+			// if there is another step after the namespace name and it is not a known namespace subresource
+			// move currentParts to include it as a resource in its own right
+			if len(currentParts) > 2 && !namespaceSubresources.Has(currentParts[2]) {
+				currentParts = currentParts[2:]
+			}
+		}
+	}
+
+	info.Parts = currentParts
+
+	// parts look like: resource/resourceName/subresource/other/stuff/we/don't/interpret
+	switch {
+	case len(info.Parts) >= 3:
+		info.Subresource = info.Parts[2]
+		fallthrough
+	case len(info.Parts) >= 2:
+		info.Name = info.Parts[1]
+		fallthrough
+	case len(info.Parts) >= 1:
+		info.Resource = info.Parts[0]
+	}
+
+	// if there's no name on the request and we thought it was a get before, then the actual verb is a list
+	if len(info.Name) == 0 && info.Verb == "get" {
+		info.Verb = "list"
+	}
+	// if there's no name on the request and we thought it was a delete before, then the actual verb is deletecollection
+	if len(info.Name) == 0 && info.Verb == "delete" {
+		info.Verb = "deletecollection"
+	}
+
+	return info
+}
+
+// GroupVersionResource returns the GroupVersionResource of the request.
+func (info *RequestInfo) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    info.APIGroup,
+		Version:  info.APIVersion,
+		Resource: info.Resource,
+	}
+}
+
+// shouldMutate returns true if the request writes an object which may be mutated by policies.
+// Non-resource requests, subresources like status, scale, eviction or binding and virtual resources like
+// TokenReview are passed through untouched.
+func (info *RequestInfo) shouldMutate() bool {
+	if !info.IsResourceRequest || len(info.Resource) == 0 || len(info.Subresource) != 0 {
+		return false
+	}
+
+	switch info.Verb {
+	case "create":
+		// name is only allowed in the url of a create request for subresources.
+		if len(info.Name) != 0 {
+			return false
+		}
+	case "update", "patch":
+		if len(info.Name) == 0 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return !virtualResources.Has(info.APIGroup + "/" + info.Resource)
+}
+
+// requestPathPrefix returns the prefix of the paths of the requests sent by clients of config before /api or
+// /apis: the path of the host, e.g. /k8s/clusters/c-xxx behind the Rancher proxy, followed by the leading segments
+// of the APIPath if it is not /api or /apis.
+func requestPathPrefix(config *rest.Config) string {
+	var prefix string
+	if u, err := url.Parse(config.Host); err == nil && len(u.Host) != 0 {
+		prefix = strings.TrimRight(u.Path, "/")
+	}
+
+	if parts := splitPath(config.APIPath); len(parts) > 1 {
+		prefix += "/" + strings.Join(parts[:len(parts)-1], "/")
+	}
+	return prefix
+}
+
+// splitPath returns the segments for a URL path.
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
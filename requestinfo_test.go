@@ -0,0 +1,218 @@
+package pidalio
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestParseRequestInfo(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		url        string
+		prefix     string
+		want       *RequestInfo
+		wantMutate bool
+	}{
+		{
+			name:   "create namespaced resource",
+			method: http.MethodPost,
+			url:    "/apis/apps/v1/namespaces/default/deployments?fieldManager=test",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/apps/v1/namespaces/default/deployments",
+				Verb:              "create",
+				APIPrefix:         "apis",
+				APIGroup:          "apps",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "deployments",
+				Parts:             []string{"deployments"},
+			},
+			wantMutate: true,
+		},
+		{
+			name:   "update core resource",
+			method: http.MethodPut,
+			url:    "/api/v1/namespaces/default/pods/web-1",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods/web-1",
+				Verb:              "update",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+				Name:              "web-1",
+				Parts:             []string{"pods", "web-1"},
+			},
+			wantMutate: true,
+		},
+		{
+			name:   "patch cluster scoped resource",
+			method: http.MethodPatch,
+			url:    "/api/v1/nodes/node-1",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/nodes/node-1",
+				Verb:              "patch",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Resource:          "nodes",
+				Name:              "node-1",
+				Parts:             []string{"nodes", "node-1"},
+			},
+			wantMutate: true,
+		},
+		{
+			name:   "update namespace status",
+			method: http.MethodPut,
+			url:    "/api/v1/namespaces/default/status",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/status",
+				Verb:              "update",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "namespaces",
+				Name:              "default",
+				Subresource:       "status",
+				Parts:             []string{"namespaces", "default", "status"},
+			},
+			wantMutate: false,
+		},
+		{
+			name:   "create eviction",
+			method: http.MethodPost,
+			url:    "/api/v1/namespaces/default/pods/web-1/eviction",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods/web-1/eviction",
+				Verb:              "create",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+				Name:              "web-1",
+				Subresource:       "eviction",
+				Parts:             []string{"pods", "web-1", "eviction"},
+			},
+			wantMutate: false,
+		},
+		{
+			name:   "create token review",
+			method: http.MethodPost,
+			url:    "/apis/authentication.k8s.io/v1/tokenreviews",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/apis/authentication.k8s.io/v1/tokenreviews",
+				Verb:              "create",
+				APIPrefix:         "apis",
+				APIGroup:          "authentication.k8s.io",
+				APIVersion:        "v1",
+				Resource:          "tokenreviews",
+				Parts:             []string{"tokenreviews"},
+			},
+			wantMutate: false,
+		},
+		{
+			name:   "delete collection",
+			method: http.MethodDelete,
+			url:    "/api/v1/namespaces/default/pods",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/api/v1/namespaces/default/pods",
+				Verb:              "deletecollection",
+				APIPrefix:         "api",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "pods",
+				Parts:             []string{"pods"},
+			},
+			wantMutate: false,
+		},
+		{
+			name:   "patch behind a proxy with path prefix",
+			method: http.MethodPatch,
+			url:    "/k8s/clusters/c-xxx/apis/apps/v1/namespaces/default/deployments/web",
+			prefix: "/k8s/clusters/c-xxx",
+			want: &RequestInfo{
+				IsResourceRequest: true,
+				Path:              "/k8s/clusters/c-xxx/apis/apps/v1/namespaces/default/deployments/web",
+				Verb:              "patch",
+				APIPrefix:         "apis",
+				APIGroup:          "apps",
+				APIVersion:        "v1",
+				Namespace:         "default",
+				Resource:          "deployments",
+				Name:              "web",
+				Parts:             []string{"deployments", "web"},
+			},
+			wantMutate: true,
+		},
+		{
+			name:   "non resource request",
+			method: http.MethodPost,
+			url:    "/version",
+			want: &RequestInfo{
+				Path: "/version",
+				Verb: "post",
+			},
+			wantMutate: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "https://127.0.0.1"+tt.url, nil)
+			got := parseRequestInfo(req, tt.prefix)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseRequestInfo() = %+v, want %+v", got, tt.want)
+			}
+			if mutate := got.shouldMutate(); mutate != tt.wantMutate {
+				t.Errorf("shouldMutate() = %v, want %v", mutate, tt.wantMutate)
+			}
+		})
+	}
+}
+
+func TestRequestPathPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *rest.Config
+		want   string
+	}{
+		{
+			name:   "host without path",
+			config: &rest.Config{Host: "https://127.0.0.1:6443"},
+		},
+		{
+			name:   "host without scheme",
+			config: &rest.Config{Host: "127.0.0.1:6443"},
+		},
+		{
+			name:   "host with path",
+			config: &rest.Config{Host: "https://rancher.example.com/k8s/clusters/c-xxx/"},
+			want:   "/k8s/clusters/c-xxx",
+		},
+		{
+			name:   "host and api path with prefix",
+			config: &rest.Config{Host: "https://rancher.example.com/k8s/clusters/c-xxx", APIPath: "/proxy/apis"},
+			want:   "/k8s/clusters/c-xxx/proxy",
+		},
+		{
+			name:   "api path",
+			config: &rest.Config{Host: "https://127.0.0.1:6443", APIPath: "/apis"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestPathPrefix(tt.config); got != tt.want {
+				t.Errorf("requestPathPrefix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
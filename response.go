@@ -0,0 +1,37 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// statusResponse returns a response carrying status as the apiserver does when it rejects a request,
+// so clients decode it to the same StatusError.
+func statusResponse(req *http.Request, status metav1.Status) (*http.Response, error) {
+	status.APIVersion = "v1"
+	status.Kind = "Status"
+	status.Status = metav1.StatusFailure
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+
+	code := int(status.Code)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,208 @@
+package pidalio
+
+import (
+	"context"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+type contextKey int
+
+const (
+	withoutOverridesKey contextKey = iota
+	policyScopeKey
+)
+
+// WithoutOverrides returns a copy of ctx which makes the transport send requests untouched: no policy or mutator is
+// applied and no policy is validated. Clients pass ctx to requests, e.g. client.Update(ctx, obj) of controller-runtime.
+func WithoutOverrides(ctx context.Context) context.Context {
+	return context.WithValue(ctx, withoutOverridesKey, true)
+}
+
+// WithOnlyPolicies returns a copy of ctx which makes the transport apply only the (Cluster)OverridePolicies with the
+// given names. No policy is applied if names is empty. Mutators are not affected.
+func WithOnlyPolicies(ctx context.Context, names ...string) context.Context {
+	scope := policyScopeFrom(ctx).copy()
+	scope.names = sets.NewString(names...)
+	return context.WithValue(ctx, policyScopeKey, scope)
+}
+
+// WithPolicyLabels returns a copy of ctx which makes the transport apply only the (Cluster)OverridePolicies whose
+// labels match selector. Mutators are not affected.
+func WithPolicyLabels(ctx context.Context, selector labels.Selector) context.Context {
+	scope := policyScopeFrom(ctx).copy()
+	scope.selector = selector
+	return context.WithValue(ctx, policyScopeKey, scope)
+}
+
+// overridesDisabled returns true if ctx is returned by WithoutOverrides.
+func overridesDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(withoutOverridesKey).(bool)
+	return disabled
+}
+
+// policyScope limits the policies applied on a request.
+type policyScope struct {
+	// names are the names of the policies applied, all the names are allowed if it is nil.
+	names sets.String
+	// selector selects the labels of the policies applied, all the labels are allowed if it is nil.
+	selector labels.Selector
+	// client is the identity of the client sending the request, matched by the client selectors of policies.
+	// A nil client is matched as an empty identity.
+	client *ClientIdentity
+	// reflected are the policies already reflected in the object, which are not applied again. The keys of
+	// OverridePolicies are namespace/name.
+	reflected sets.String
+}
+
+// policyScopeFrom returns the scope of policies set to ctx, or nil if policies are not scoped.
+func policyScopeFrom(ctx context.Context) *policyScope {
+	scope, _ := ctx.Value(policyScopeKey).(*policyScope)
+	return scope
+}
+
+func (s *policyScope) copy() *policyScope {
+	if s == nil {
+		return &policyScope{}
+	}
+
+	scope := *s
+	return &scope
+}
+
+// matches returns true if obj is in the scope, the client selector of obj is looked up from selectors.
+func (s *policyScope) matches(obj metav1.Object, selectors *clientSelectors) bool {
+	if s.reflected.Has(policyKey(obj)) {
+		return false
+	}
+	if s.names != nil && !s.names.Has(obj.GetName()) {
+		return false
+	}
+
+	if s.selector != nil && !s.selector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+
+	var client ClientIdentity
+	if s.client != nil {
+		client = *s.client
+	}
+	return matchesClient(obj, client, selectors)
+}
+
+// policyKey returns the name of a ClusterOverridePolicy, or namespace/name of an OverridePolicy.
+func policyKey(obj metav1.Object) string {
+	if len(obj.GetNamespace()) == 0 {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// scoped returns true if scope may filter out any policy, so policies are applied by a scoped override manager.
+func (e *policyEngine) scoped(scope *policyScope) bool {
+	if scope == nil {
+		return false
+	}
+
+	return scope.names != nil || scope.selector != nil || e.selectsClients()
+}
+
+// scopedOverrideManager returns an override manager applying the policies in scope only.
+func (e *policyEngine) scopedOverrideManager(scope *policyScope) overridemanager.OverrideManager {
+	return overridemanager.NewOverrideManager(e.drLister,
+		&scopedClusterOverridePolicyLister{lister: e.copLister, scope: scope, selectors: e.clientSelectors},
+		&scopedOverridePolicyLister{lister: e.opLister, scope: scope, selectors: e.clientSelectors})
+}
+
+// scopedClusterOverridePolicyLister lists the ClusterOverridePolicies in scope only.
+type scopedClusterOverridePolicyLister struct {
+	lister    v1alpha1.ClusterOverridePolicyLister
+	scope     *policyScope
+	selectors *clientSelectors
+}
+
+func (l *scopedClusterOverridePolicyLister) List(selector labels.Selector) ([]*policyv1alpha1.ClusterOverridePolicy, error) {
+	cops, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*policyv1alpha1.ClusterOverridePolicy
+	for _, cop := range cops {
+		if l.scope.matches(cop, l.selectors) {
+			ret = append(ret, cop)
+		}
+	}
+	return ret, nil
+}
+
+func (l *scopedClusterOverridePolicyLister) Get(name string) (*policyv1alpha1.ClusterOverridePolicy, error) {
+	cop, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !l.scope.matches(cop, l.selectors) {
+		return nil, apierrors.NewNotFound(policyv1alpha1.Resource("clusteroverridepolicy"), name)
+	}
+	return cop, nil
+}
+
+// scopedOverridePolicyLister lists the OverridePolicies in scope only.
+type scopedOverridePolicyLister struct {
+	lister    v1alpha1.OverridePolicyLister
+	scope     *policyScope
+	selectors *clientSelectors
+}
+
+func (l *scopedOverridePolicyLister) List(selector labels.Selector) ([]*policyv1alpha1.OverridePolicy, error) {
+	ops, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return l.filter(ops), nil
+}
+
+func (l *scopedOverridePolicyLister) OverridePolicies(namespace string) v1alpha1.OverridePolicyNamespaceLister {
+	return &scopedOverridePolicyNamespaceLister{lister: l.lister.OverridePolicies(namespace), parent: l}
+}
+
+func (l *scopedOverridePolicyLister) filter(ops []*policyv1alpha1.OverridePolicy) []*policyv1alpha1.OverridePolicy {
+	var ret []*policyv1alpha1.OverridePolicy
+	for _, op := range ops {
+		if l.scope.matches(op, l.selectors) {
+			ret = append(ret, op)
+		}
+	}
+	return ret
+}
+
+type scopedOverridePolicyNamespaceLister struct {
+	lister v1alpha1.OverridePolicyNamespaceLister
+	parent *scopedOverridePolicyLister
+}
+
+func (l *scopedOverridePolicyNamespaceLister) List(selector labels.Selector) ([]*policyv1alpha1.OverridePolicy, error) {
+	ops, err := l.lister.List(selector)
+	if err != nil {
+		return nil, err
+	}
+	return l.parent.filter(ops), nil
+}
+
+func (l *scopedOverridePolicyNamespaceLister) Get(name string) (*policyv1alpha1.OverridePolicy, error) {
+	op, err := l.lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !l.parent.scope.matches(op, l.parent.selectors) {
+		return nil, apierrors.NewNotFound(policyv1alpha1.Resource("overridepolicy"), name)
+	}
+	return op, nil
+}
@@ -0,0 +1,136 @@
+package pidalio
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+)
+
+func TestPolicyTransport_RoundTripScope(t *testing.T) {
+	newSpec := func(label string) policyv1alpha1.OverridePolicySpec {
+		return policyv1alpha1.OverridePolicySpec{
+			OverrideRules: []policyv1alpha1.RuleWithOperation{
+				{
+					TargetOperations: []admissionv1.Operation{admissionv1.Create},
+					Overriders: policyv1alpha1.Overriders{
+						Plaintext: []policyv1alpha1.PlaintextOverrider{
+							{
+								Path:     "/metadata/labels/" + label,
+								Operator: "add",
+								Value:    apiextensionsv1.JSON{Raw: []byte(`"true"`)},
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	source, err := lister.NewMemoryPolicySource(
+		&policyv1alpha1.ClusterOverridePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "cop", Labels: map[string]string{"team": "a"}},
+			Spec:       newSpec("cop"),
+		},
+		&policyv1alpha1.OverridePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "default", Labels: map[string]string{"team": "b"}},
+			Spec:       newSpec("op"),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copLister := lister.NewClusterOverridePolicyLister(source)
+	opLister := lister.NewOverridePolicyLister(source)
+	engine := &policyEngine{
+		initialized:       1,
+		overrideManager:   overridemanager.NewOverrideManager(nil, copLister, opLister),
+		policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+		copLister:         copLister,
+		opLister:          opLister,
+	}
+
+	var sent *appsv1.Deployment
+	config := &rest.Config{
+		Host: "https://127.0.0.1:6443",
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := ioutil.ReadAll(req.Body)
+			obj, err := bytesToUnstructured(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent = &appsv1.Deployment{}
+			sent.SetLabels(obj.GetLabels())
+			return newResponse(http.StatusCreated, body), nil
+		}),
+	}
+	config.Wrap(engine.Wrap)
+	client := kubernetes.NewForConfigOrDie(config)
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		wantLabels []string
+	}{
+		{
+			name:       "all policies",
+			ctx:        context.Background(),
+			wantLabels: []string{"cop", "op"},
+		},
+		{
+			name: "without overrides",
+			ctx:  WithoutOverrides(context.Background()),
+		},
+		{
+			name:       "only policies",
+			ctx:        WithOnlyPolicies(context.Background(), "op"),
+			wantLabels: []string{"op"},
+		},
+		{
+			name: "no policies",
+			ctx:  WithOnlyPolicies(context.Background()),
+		},
+		{
+			name:       "policy labels",
+			ctx:        WithPolicyLabels(context.Background(), labels.SelectorFromSet(labels.Set{"team": "a"})),
+			wantLabels: []string{"cop"},
+		},
+		{
+			name:       "only policies and policy labels",
+			ctx:        WithPolicyLabels(WithOnlyPolicies(context.Background(), "cop", "op"), labels.SelectorFromSet(labels.Set{"team": "b"})),
+			wantLabels: []string{"op"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"app": "web"}}}
+			if _, err := client.AppsV1().Deployments("default").Create(tt.ctx, deployment, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("Create() error = %v", err)
+			}
+
+			got := sent.GetLabels()
+			if len(got) != len(tt.wantLabels)+1 {
+				t.Errorf("labels = %v, want %v", got, tt.wantLabels)
+			}
+			for _, label := range tt.wantLabels {
+				if got[label] != "true" {
+					t.Errorf("labels = %v, want %v", got, tt.wantLabels)
+				}
+			}
+		})
+	}
+}
@@ -2,26 +2,25 @@ package pidalio
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
-	"reflect"
-	"strconv"
-	"time"
+	"fmt"
 
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/client-go/discovery"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 
 	"github.com/k-cloud-labs/pidalio/pkg/lister"
 	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
-	"github.com/k-cloud-labs/pkg/client/clientset/versioned"
 	clientsetscheme "github.com/k-cloud-labs/pkg/client/clientset/versioned/scheme"
 	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
 	"github.com/k-cloud-labs/pkg/utils/dynamiclister"
@@ -32,6 +31,7 @@ import (
 	"github.com/k-cloud-labs/pkg/utils/templatemanager"
 	"github.com/k-cloud-labs/pkg/utils/templatemanager/templates"
 	"github.com/k-cloud-labs/pkg/utils/tokenmanager"
+	"github.com/k-cloud-labs/pkg/utils/validatemanager"
 )
 
 // aggregatedScheme aggregates Kubernetes and extended schemes.
@@ -51,19 +51,44 @@ func NewForConfig(config *rest.Config) (client.Client, error) {
 }
 
 type setupManager struct {
-	policyClient             versioned.Interface
+	// ctx is canceled when the transport is stopped.
+	ctx context.Context
+	// rawConfig is the config before the transport is registered, requests sent by it are not mutated.
+	rawConfig                *rest.Config
 	client                   client.Client
 	drLister                 dynamiclister.DynamicResourceLister
 	opLister                 v1alpha1.OverridePolicyLister
 	copLister                v1alpha1.ClusterOverridePolicyLister
-	informerManager          informermanager.SingleClusterInformerManager
+	cvpLister                v1alpha1.ClusterValidatePolicyLister
 	overrideManager          overridemanager.OverrideManager
+	validateManager          validatemanager.ValidateManager
 	policyInterrupterManager interrupter.PolicyInterrupterManager
 	tokenManager             tokenmanager.TokenManager
+	objectCache              *objectCache
+	lastSyncTime             *lastSyncTimeElector
+	reconciler               *policyReconciler
+	events                   *policyEvents
+	policySource             lister.PolicySource
+	// policyInformers is the policy source if policies are watched from the apiserver by informers, nil otherwise.
+	policyInformers lister.InformerPolicySource
+	dynamicClient   dynamic.Interface
+	// crds waits for the policy CRDs if they are allowed to be missing, see Options.AllowMissingCRDs.
+	crds   *crdWatcher
+	status *policyStatus
+	// clientSelectors caches the client selectors of the policies watched.
+	clientSelectors *clientSelectors
 }
 
-func (s *setupManager) setupAll(cfg *rest.Config, done <-chan struct{}) error {
-	if err := s.init(cfg, done); err != nil {
+func (s *setupManager) setupAll(cfg *rest.Config, done <-chan struct{}, opts Options) error {
+	if err := s.init(cfg, done, opts.PolicySource == nil); err != nil {
+		return err
+	}
+	s.status = &policyStatus{}
+
+	if err := s.setupObjectCache(opts.OldObject.CachedResources); err != nil {
+		return err
+	}
+	if err := s.setupPolicySource(opts.PolicySource, opts.PolicyInformerScope); err != nil {
 		return err
 	}
 
@@ -71,30 +96,92 @@ func (s *setupManager) setupAll(cfg *rest.Config, done <-chan struct{}) error {
 		return err
 	}
 
+	if opts.EnableValidatePolicy {
+		s.setupValidatePolicyManager()
+	}
+
+	if s.policyInformers != nil {
+		if err := s.setSyncErrorHandlers(); err != nil {
+			return err
+		}
+		s.addStatusEventHandlers()
+		s.addClientSelectorEventHandlers()
+	}
+
 	if err := s.setupInterrupter(); err != nil {
 		return err
 	}
 
+	if opts.LastSyncTime.Enabled {
+		if s.policyInformers == nil {
+			return errors.New("last sync time requires policies to be watched from the apiserver")
+		}
+		if err := s.setupLastSyncTime(opts.LastSyncTime); err != nil {
+			return err
+		}
+	}
+
+	if opts.Events.Enabled {
+		if err := s.setupEvents(opts.Events); err != nil {
+			return err
+		}
+	}
+
+	if opts.Reconcile.Enabled {
+		// reconcile passes update every selected object again, overriders like adding to an array would be
+		// applied on each pass.
+		if !opts.IdempotentOverrides {
+			return errors.New("reconciling objects requires IdempotentOverrides")
+		}
+		if s.policyInformers == nil {
+			return errors.New("reconciling objects requires policies to be watched from the apiserver")
+		}
+		if err := s.setupReconciler(cfg, opts.Reconcile); err != nil {
+			return err
+		}
+	}
+
+	if opts.AllowMissingCRDs && s.policyInformers != nil {
+		if err := s.setupCRDWatcher(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *setupManager) init(cfg *rest.Config, done <-chan struct{}) error {
-	cli, err := NewForConfig(cfg)
+// init sets up the clients. The clients watching policies and the dynamic resource lister are only set up if
+// watchPolicies is true, so the apiserver is not contacted when policies are loaded from a static source.
+func (s *setupManager) init(cfg *rest.Config, done <-chan struct{}, watchPolicies bool) error {
+	// the client discovers the apiserver when it is used, it is only used by interrupters of policies written.
+	mapper, err := apiutil.NewDynamicRESTMapper(cfg, apiutil.WithLazyDiscovery)
 	if err != nil {
 		return err
 	}
-
-	pc, err := versioned.NewForConfig(cfg)
+	cli, err := client.New(cfg, client.Options{Scheme: aggregatedScheme, Mapper: mapper})
 	if err != nil {
 		return err
 	}
 
-	s.policyClient = pc
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	s.ctx = ctx
 	s.client = cli
-	s.informerManager = informermanager.NewSingleClusterInformerManager(dynamic.NewForConfigOrDie(cfg), 0, done)
 	s.policyInterrupterManager = interrupter.NewPolicyInterrupterManager()
 	s.tokenManager = tokenmanager.NewTokenManager()
 
+	if !watchPolicies {
+		return nil
+	}
+
+	if s.dynamicClient, err = dynamic.NewForConfig(cfg); err != nil {
+		return err
+	}
+
 	s.drLister, err = dynamiclister.NewDynamicResourceLister(cfg, done)
 	if err != nil {
 		klog.ErrorS(err, "failed to init dynamic client.")
@@ -104,15 +191,159 @@ func (s *setupManager) init(cfg *rest.Config, done <-chan struct{}) error {
 	return nil
 }
 
-func (s *setupManager) waitForCacheSync() error {
-	s.informerManager.Start()
-	if result := s.informerManager.WaitForCacheSync(); !result[opGVR] || !result[copGVR] {
+func (s *setupManager) start() error {
+	startPolicySource := func() error {
+		if err := s.policySource.Start(s.ctx.Done()); err != nil {
+			return err
+		}
+		go s.warnIfNotSynced(s.ctx)
+		return nil
+	}
+	if s.crds != nil {
+		if err := s.crds.start(s.ctx, startPolicySource, s.policiesSynced); err != nil {
+			return err
+		}
+	} else if err := startPolicySource(); err != nil {
+		return err
+	}
+
+	if s.lastSyncTime != nil {
+		go s.lastSyncTime.run(s.ctx)
+	}
+
+	if s.reconciler != nil {
+		go s.reconciler.run(s.ctx)
+	}
+
+	return nil
+}
+
+// waitForCacheSync waits for the policy informers and the object cache informers to be synced until stopCh is closed.
+// Failing to sync the object cache is not fatal, old objects are resolved without cache then.
+func (s *setupManager) waitForCacheSync(stopCh <-chan struct{}) error {
+	informersSynced := []cache.InformerSynced{
+		s.policySynced(opGVR),
+		s.policySynced(copGVR),
+	}
+	if s.validateManager != nil {
+		informersSynced = append(informersSynced, s.policySynced(cvpGVR))
+	}
+	objectsSynced := s.objectCache.synced()
+	for _, synced := range objectsSynced {
+		informersSynced = append(informersSynced, synced)
+	}
+
+	if cache.WaitForCacheSync(stopCh, informersSynced...) {
+		return nil
+	}
+
+	if !s.policySource.HasSynced(opGVR) || !s.policySource.HasSynced(copGVR) {
 		return errors.New("failed to sync override policy")
 	}
 
+	if s.validateManager != nil && !s.policySource.HasSynced(cvpGVR) {
+		return errors.New("failed to sync validate policy")
+	}
+
+	for gvr, synced := range objectsSynced {
+		if !synced() {
+			klog.InfoS("failed to sync object cache, old objects will not be resolved from cache.", "resource", gvr)
+		}
+	}
+
+	return nil
+}
+
+// policiesSynced returns true if all the policies used by the transport are synced.
+func (s *setupManager) policiesSynced() bool {
+	if s.validateManager != nil && !s.policySource.HasSynced(cvpGVR) {
+		return false
+	}
+
+	return s.policySource.HasSynced(opGVR) && s.policySource.HasSynced(copGVR)
+}
+
+func (s *setupManager) policySynced(gvr schema.GroupVersionResource) cache.InformerSynced {
+	return func() bool {
+		return s.policySource.HasSynced(gvr)
+	}
+}
+
+// setupPolicySource sets up where policies are loaded from, policies are watched from the apiserver if source is nil.
+// The policies watched are limited to scope unless it is nil. Policies are watched by informers of their own, so
+// that they can be started after the object cache once the policy CRDs are installed.
+func (s *setupManager) setupPolicySource(source lister.PolicySource, scope *lister.InformerScope) error {
+	if source != nil {
+		s.policySource = source
+		return nil
+	}
+
+	if scope == nil {
+		s.policyInformers = lister.NewInformerPolicySource(
+			informermanager.NewSingleClusterInformerManager(s.dynamicClient, 0, s.ctx.Done()))
+		s.policySource = s.policyInformers
+		return nil
+	}
+
+	if len(scope.LabelSelector) != 0 {
+		if _, err := labels.Parse(scope.LabelSelector); err != nil {
+			return fmt.Errorf("invalid policy label selector: %v", err)
+		}
+	}
+
+	s.policyInformers = lister.NewScopedInformerPolicySource(s.dynamicClient, *scope)
+	s.policySource = s.policyInformers
 	return nil
 }
 
+// setupCRDWatcher waits for the CRDs of the policies watched when the transport is started.
+func (s *setupManager) setupCRDWatcher() error {
+	dc, err := discovery.NewDiscoveryClientForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+
+	var watched []schema.GroupVersionResource
+	for _, resource := range s.policyResources() {
+		// ClusterOverridePolicies are not watched if they are skipped.
+		if len(s.policyInformers.Informers(resource)) != 0 {
+			watched = append(watched, resource)
+		}
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(s.rawConfig)
+	if err != nil {
+		return err
+	}
+	s.crds = newCRDWatcher(dc, s.dynamicClient, kubeClient.AuthorizationV1().SelfSubjectAccessReviews(), watched)
+	return nil
+}
+
+// addPolicyEventHandler adds handler to the informers watching policies of gvr.
+func (s *setupManager) addPolicyEventHandler(gvr schema.GroupVersionResource, handler cache.ResourceEventHandler) {
+	for _, informer := range s.policyInformers.Informers(gvr) {
+		informer.AddEventHandler(handler)
+	}
+}
+
+// setupObjectCache registers the resources opted in to resolve old objects from cache to the dynamic resource lister.
+func (s *setupManager) setupObjectCache(resources []schema.GroupVersionResource) (err error) {
+	if len(resources) == 0 {
+		return nil
+	}
+	if s.drLister == nil {
+		return errors.New("caching old objects requires policies to be watched from the apiserver")
+	}
+
+	listers, ok := s.drLister.(resourceListers)
+	if !ok {
+		return fmt.Errorf("dynamic resource lister %T can not cache resources", s.drLister)
+	}
+
+	s.objectCache, err = newObjectCache(listers, resources)
+	return err
+}
+
 func (s *setupManager) setupInterrupter() error {
 	otm, err := templatemanager.NewOverrideTemplateManager(&templatemanager.TemplateSource{
 		Content:      templates.OverrideTemplate,
@@ -153,23 +384,24 @@ func (s *setupManager) setupInterrupter() error {
 }
 
 var (
-	opGVR = schema.GroupVersionResource{
-		Group:    policyv1alpha1.SchemeGroupVersion.Group,
-		Version:  policyv1alpha1.SchemeGroupVersion.Version,
-		Resource: "overridepolicies",
-	}
-	copGVR = schema.GroupVersionResource{
-		Group:    policyv1alpha1.SchemeGroupVersion.Group,
-		Version:  policyv1alpha1.SchemeGroupVersion.Version,
-		Resource: "clusteroverridepolicies",
-	}
+	opGVR  = lister.OverridePolicyResource
+	copGVR = lister.ClusterOverridePolicyResource
+	cvpGVR = lister.ClusterValidatePolicyResource
 )
 
 func (s *setupManager) setupOverridePolicyManager() (err error) {
-	opInformer := s.informerManager.Informer(opGVR)
-	copInformer := s.informerManager.Informer(copGVR)
+	if s.policyInformers != nil {
+		s.addOverridePolicyEventHandlers()
+	}
 
-	opInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	s.opLister = lister.NewOverridePolicyLister(s.policySource)
+	s.copLister = lister.NewClusterOverridePolicyLister(s.policySource)
+	s.overrideManager = overridemanager.NewOverrideManager(s.drLister, s.copLister, s.opLister)
+	return nil
+}
+
+func (s *setupManager) addOverridePolicyEventHandlers() {
+	s.addPolicyEventHandler(opGVR, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			metrics.IncrPolicy("OverridePolicy")
 			_ = s.onAddOverridePolicyPolicy(obj)
@@ -182,7 +414,7 @@ func (s *setupManager) setupOverridePolicyManager() (err error) {
 		},
 	})
 
-	copInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+	s.addPolicyEventHandler(copGVR, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			metrics.IncrPolicy("ClusterOverridePolicy")
 			_ = s.onAddClusterOverridePolicy(obj)
@@ -194,87 +426,34 @@ func (s *setupManager) setupOverridePolicyManager() (err error) {
 			metrics.DecPolicy("ClusterOverridePolicy")
 		},
 	})
-
-	s.opLister = lister.NewUnstructuredOverridePolicyLister(opInformer.GetIndexer())
-	s.copLister = lister.NewUnstructuredClusterOverridePolicyLister(copInformer.GetIndexer())
-	s.overrideManager = overridemanager.NewOverrideManager(s.drLister, s.copLister, s.opLister)
-	return nil
-}
-
-const (
-	lastSyncTimeAnno = "policy.kcloudlabs.io/last-sync-time"
-)
-
-func (s *setupManager) onAddOverridePolicyPolicy(obj any) error {
-	op := new(policyv1alpha1.OverridePolicy)
-	if err := convertToPolicy(obj.(*unstructured.Unstructured), op); err != nil {
-		return err
-	}
-
-	op.Annotations[lastSyncTimeAnno] = strconv.FormatInt(time.Now().UnixNano(), 10)
-	_, err := s.policyClient.PolicyV1alpha1().OverridePolicies(op.GetNamespace()).Update(context.TODO(), op, metav1.UpdateOptions{})
-
-	return err
-}
-
-func (s *setupManager) onUpdaterOverridePolicyPolicy(oldObj, newObj any) error {
-	old := new(policyv1alpha1.OverridePolicy)
-	if err := convertToPolicy(oldObj.(*unstructured.Unstructured), old); err != nil {
-		return err
-	}
-
-	current := new(policyv1alpha1.OverridePolicy)
-	if err := convertToPolicy(newObj.(*unstructured.Unstructured), current); err != nil {
-		return err
-	}
-
-	if reflect.DeepEqual(current.Spec, old.Spec) {
-		return nil
-	}
-
-	current.Annotations[lastSyncTimeAnno] = strconv.FormatInt(time.Now().UnixNano(), 10)
-	_, err := s.policyClient.PolicyV1alpha1().OverridePolicies(current.GetNamespace()).Update(context.TODO(), current, metav1.UpdateOptions{})
-	return err
 }
 
-func (s *setupManager) onAddClusterOverridePolicy(obj any) error {
-	cop := new(policyv1alpha1.ClusterOverridePolicy)
-	if err := convertToPolicy(obj.(*unstructured.Unstructured), cop); err != nil {
-		return err
+func (s *setupManager) setupValidatePolicyManager() {
+	if s.policyInformers != nil {
+		s.addPolicyEventHandler(cvpGVR, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				metrics.IncrPolicy("ClusterValidatePolicy")
+			},
+			DeleteFunc: func(obj interface{}) {
+				metrics.DecPolicy("ClusterValidatePolicy")
+			},
+		})
 	}
 
-	cop.Annotations[lastSyncTimeAnno] = strconv.FormatInt(time.Now().UnixNano(), 10)
-	_, err := s.policyClient.PolicyV1alpha1().ClusterOverridePolicies().Update(context.TODO(), cop, metav1.UpdateOptions{})
-
-	return err
+	s.cvpLister = lister.NewClusterValidatePolicyLister(s.policySource)
+	s.validateManager = validatemanager.NewValidateManager(s.drLister, s.cvpLister)
 }
 
-func (s *setupManager) onUpdateClusterOverridePolicy(oldObj, newObj any) error {
-	old := new(policyv1alpha1.ClusterOverridePolicy)
-	if err := convertToPolicy(oldObj.(*unstructured.Unstructured), old); err != nil {
-		return err
+func (s *setupManager) failurePolicyResolver(failurePolicy FailurePolicyType) *failurePolicyResolver {
+	if failurePolicy != Ignore {
+		failurePolicy = Fail
 	}
 
-	current := new(policyv1alpha1.ClusterOverridePolicy)
-	if err := convertToPolicy(newObj.(*unstructured.Unstructured), current); err != nil {
-		return err
-	}
-
-	if reflect.DeepEqual(current.Spec, old.Spec) {
-		return nil
+	return &failurePolicyResolver{
+		defaultPolicy: failurePolicy,
+		drLister:      s.drLister,
+		copLister:     s.copLister,
+		opLister:      s.opLister,
+		results:       utilcache.NewLRUExpireCache(failsAloneCacheSize),
 	}
-
-	current.Annotations[lastSyncTimeAnno] = strconv.FormatInt(time.Now().UnixNano(), 10)
-	_, err := s.policyClient.PolicyV1alpha1().ClusterOverridePolicies().Update(context.TODO(), current, metav1.UpdateOptions{})
-	return err
-}
-
-func convertToPolicy(u *unstructured.Unstructured, data any) error {
-	klog.V(4).Infof("convertToPolicy, obj=%v", u)
-	b, err := u.MarshalJSON()
-	if err != nil {
-		return err
-	}
-
-	return json.Unmarshal(b, data)
 }
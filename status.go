@@ -0,0 +1,205 @@
+package pidalio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// Status is the status of the policies used by the transport.
+type Status struct {
+	// Readiness is the readiness state of the transport.
+	Readiness Readiness
+	// Synced reports if the policies of every kind used are synced, keyed by kind.
+	Synced map[string]bool
+	// Policies is the number of policies loaded per kind.
+	Policies map[string]int
+	// LastPolicyChange is the time of the last event of the policies watched from the apiserver, or the time
+	// policies were synced for other policy sources. It is zero until then.
+	LastPolicyChange time.Time
+	// LastError is the last error evaluating policies on a request, nil if none happened.
+	LastError error
+	// LastErrorTime is the time LastError happened.
+	LastErrorTime time.Time
+	// SyncError is the last error listing or watching the policies from the apiserver while they are not synced,
+	// e.g. the RBAC to list and watch them is missing. It is nil once they are synced.
+	SyncError error
+}
+
+// policySyncWarningTimeout is the time after which a warning is logged if the policies are not synced yet.
+const policySyncWarningTimeout = time.Minute
+
+// policyStatus records when policies change and when evaluating them fails.
+type policyStatus struct {
+	lock             sync.RWMutex
+	lastPolicyChange time.Time
+	lastError        error
+	lastErrorTime    time.Time
+	lastSyncError    error
+}
+
+func (s *policyStatus) policiesChanged() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastPolicyChange = time.Now()
+}
+
+func (s *policyStatus) failed(err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastError = err
+	s.lastErrorTime = time.Now()
+}
+
+func (s *policyStatus) syncFailed(err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastSyncError = err
+}
+
+func (s *policyStatus) syncError() error {
+	if s == nil {
+		return nil
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastSyncError
+}
+
+// setSyncErrorHandlers records the errors listing and watching the policies from the apiserver, it must be called
+// before the informers are started.
+func (s *setupManager) setSyncErrorHandlers() error {
+	handler := func(r *cache.Reflector, err error) {
+		cache.DefaultWatchErrorHandler(r, err)
+		s.status.syncFailed(err)
+	}
+	for _, gvr := range s.policyResources() {
+		for _, informer := range s.policyInformers.Informers(gvr) {
+			if err := informer.SetWatchErrorHandler(handler); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warnIfNotSynced logs a warning with the last sync error if the policies are not synced within
+// policySyncWarningTimeout, so policies never synced, e.g. for missing RBAC, are not left unnoticed.
+func (s *setupManager) warnIfNotSynced(ctx context.Context) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, policySyncWarningTimeout)
+	defer cancel()
+	if cache.WaitForCacheSync(timeoutCtx.Done(), s.policiesSynced) || ctx.Err() != nil {
+		return
+	}
+
+	klog.Warningf("Policies are not synced after %s, they are not applied on requests until they are synced, last error: %v",
+		policySyncWarningTimeout, s.status.syncError())
+}
+
+// addStatusEventHandlers records the events of the policies watched from the apiserver as policy changes.
+func (s *setupManager) addStatusEventHandlers() {
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			s.status.policiesChanged()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			s.status.policiesChanged()
+		},
+		DeleteFunc: func(obj interface{}) {
+			s.status.policiesChanged()
+		},
+	}
+	for _, gvr := range s.policyResources() {
+		s.addPolicyEventHandler(gvr, handler)
+	}
+}
+
+// policyResources returns the resources of the policies used by the transport.
+func (s *setupManager) policyResources() []schema.GroupVersionResource {
+	resources := []schema.GroupVersionResource{opGVR, copGVR}
+	if s.validateManager != nil {
+		resources = append(resources, cvpGVR)
+	}
+	return resources
+}
+
+// Status returns the status of the policies used by the transport.
+func (t *Transport) Status() Status {
+	status := Status{
+		Readiness: t.Readiness(),
+		Synced:    make(map[string]bool),
+		Policies:  make(map[string]int),
+	}
+
+	synced := true
+	for _, gvr := range t.setup.policyResources() {
+		kind := policyKinds[gvr]
+		status.Synced[kind] = t.setup.policySource.HasSynced(gvr)
+		status.Policies[kind] = len(t.setup.policySource.Indexer(gvr).ListKeys())
+		synced = synced && status.Synced[kind]
+	}
+
+	t.setup.status.lock.RLock()
+	defer t.setup.status.lock.RUnlock()
+	status.LastPolicyChange = t.setup.status.lastPolicyChange
+	status.LastError = t.setup.status.lastError
+	status.LastErrorTime = t.setup.status.lastErrorTime
+	if !synced {
+		status.SyncError = t.setup.status.lastSyncError
+	}
+	return status
+}
+
+// policyKinds maps the resources of policies to their kinds.
+var policyKinds = map[schema.GroupVersionResource]string{
+	opGVR:  "OverridePolicy",
+	copGVR: "ClusterOverridePolicy",
+	cvpGVR: "ClusterValidatePolicy",
+}
+
+// ReadyzCheck returns a healthz.Checker failing until policies are loaded, with the error listing or watching them
+// if any, e.g. to refuse traffic until then by the readyz endpoint of a controller-runtime manager:
+//
+//	mgr.AddReadyzCheck("pidalio", t.ReadyzCheck())
+func (t *Transport) ReadyzCheck() healthz.Checker {
+	return func(_ *http.Request) error {
+		if readiness := t.Readiness(); readiness != Ready {
+			if err := t.setup.status.syncError(); err != nil && readiness == Syncing {
+				return fmt.Errorf("policies are not loaded: %s: %w", readiness, err)
+			}
+			return fmt.Errorf("policies are not loaded: %s", readiness)
+		}
+		return nil
+	}
+}
+
+// HealthzCheck returns a healthz.Checker failing once the transport is stopped.
+func (t *Transport) HealthzCheck() healthz.Checker {
+	return func(_ *http.Request) error {
+		if t.Readiness() == Stopped {
+			return errors.New("policy transport is stopped")
+		}
+		return nil
+	}
+}
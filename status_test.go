@@ -0,0 +1,140 @@
+package pidalio
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/k-cloud-labs/pidalio/pkg/lister"
+	policyv1alpha1 "github.com/k-cloud-labs/pkg/apis/policy/v1alpha1"
+)
+
+func TestTransport_Status(t *testing.T) {
+	source, err := lister.NewMemoryPolicySource(
+		&policyv1alpha1.ClusterOverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "cop"}},
+		&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "default"}},
+		&policyv1alpha1.OverridePolicy{ObjectMeta: metav1.ObjectMeta{Name: "op", Namespace: "team-a"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		started       bool
+		stopped       bool
+		crdsMissing   bool
+		err           error
+		wantReadiness Readiness
+		wantReady     bool
+		wantHealthy   bool
+	}{
+		{
+			name:          "not started",
+			wantReadiness: NotStarted,
+			wantHealthy:   true,
+		},
+		{
+			name:          "ready",
+			started:       true,
+			wantReadiness: Ready,
+			wantReady:     true,
+			wantHealthy:   true,
+		},
+		{
+			name:          "ready with evaluation error",
+			started:       true,
+			err:           errors.New("invalid overrider"),
+			wantReadiness: Ready,
+			wantReady:     true,
+			wantHealthy:   true,
+		},
+		{
+			name:          "waiting for crds",
+			started:       true,
+			crdsMissing:   true,
+			wantReadiness: WaitingForCRDs,
+			wantHealthy:   true,
+		},
+		{
+			name:          "stopped",
+			started:       true,
+			stopped:       true,
+			wantReadiness: Stopped,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &Transport{
+				setup:     &setupManager{policySource: source, status: &policyStatus{}},
+				startedCh: make(chan struct{}),
+				stopCh:    make(chan struct{}),
+			}
+			if tt.started {
+				close(tr.startedCh)
+			}
+			if tt.stopped {
+				tr.Stop()
+			}
+			if tt.crdsMissing {
+				tr.setup.crds = &crdWatcher{missing: 1}
+			}
+			if tt.err != nil {
+				tr.setup.status.failed(tt.err)
+			}
+
+			status := tr.Status()
+			if status.Readiness != tt.wantReadiness {
+				t.Errorf("Readiness = %v, want %v", status.Readiness, tt.wantReadiness)
+			}
+			if status.Policies["ClusterOverridePolicy"] != 1 || status.Policies["OverridePolicy"] != 2 {
+				t.Errorf("Policies = %v, want 1 ClusterOverridePolicy and 2 OverridePolicies", status.Policies)
+			}
+			if !status.Synced["ClusterOverridePolicy"] || !status.Synced["OverridePolicy"] {
+				t.Errorf("Synced = %v, want all synced", status.Synced)
+			}
+			if _, ok := status.Synced["ClusterValidatePolicy"]; ok {
+				t.Errorf("Synced = %v, want ClusterValidatePolicy not used", status.Synced)
+			}
+			if status.LastError != tt.err || status.LastErrorTime.IsZero() != (tt.err == nil) {
+				t.Errorf("LastError = %v at %v, want %v", status.LastError, status.LastErrorTime, tt.err)
+			}
+
+			if err := tr.ReadyzCheck()(nil); (err == nil) != tt.wantReady {
+				t.Errorf("ReadyzCheck() error = %v, want ready %v", err, tt.wantReady)
+			}
+			if err := tr.HealthzCheck()(nil); (err == nil) != tt.wantHealthy {
+				t.Errorf("HealthzCheck() error = %v, want healthy %v", err, tt.wantHealthy)
+			}
+		})
+	}
+}
+
+func TestTransport_StatusSyncError(t *testing.T) {
+	tr, err := New(unreachableConfig(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Stop()
+	if err = tr.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the policies can not be listed from the apiserver.
+	if err = wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return tr.Status().SyncError != nil, nil
+	}); err != nil {
+		t.Fatalf("Status().SyncError = nil, want the error listing policies")
+	}
+	if got := tr.Readiness(); got != Syncing {
+		t.Errorf("Readiness() = %v, want %v", got, Syncing)
+	}
+	syncErr := tr.Status().SyncError
+	if err = tr.ReadyzCheck()(nil); !errors.Is(err, syncErr) {
+		t.Errorf("ReadyzCheck() error = %v, want it to wrap %v", err, syncErr)
+	}
+}
@@ -0,0 +1,117 @@
+package pidalio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/k-cloud-labs/pidalio"
+
+// span attributes.
+const (
+	attrGroup       = "k8s.group"
+	attrVersion     = "k8s.version"
+	attrKind        = "k8s.kind"
+	attrNamespace   = "k8s.namespace"
+	attrName        = "k8s.name"
+	attrVerb        = "pidalio.verb"
+	attrOutcome     = "pidalio.outcome"
+	attrPolicy      = "pidalio.policy"
+	attrPolicies    = "pidalio.policies"
+	attrPatchCount  = "pidalio.patch_count"
+	attrPolicyCount = "pidalio.policy_count"
+)
+
+// Tracer traces the requests mutated by the transport. Use NewOpenTelemetryTracer to trace by OpenTelemetry.
+type Tracer interface {
+	// Start starts a span as a child of the span in ctx, and returns ctx carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject injects the trace context in ctx into the headers of a request sent to the delegate.
+	Inject(ctx context.Context, header http.Header)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute, value is a string, []string, bool, int or int64.
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// startSpan starts a span by tracer, it returns a no-op span if tracer is nil.
+func startSpan(ctx context.Context, tracer Tracer, name string) (context.Context, Span) {
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+
+	return tracer.Start(ctx, name)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+// otelTracer traces by an OpenTelemetry TracerProvider.
+type otelTracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// NewOpenTelemetryTracer returns a Tracer starting spans by provider and injecting the trace context into
+// requests by propagator, e.g. otel.GetTracerProvider() and otel.GetTextMapPropagator().
+func NewOpenTelemetryTracer(provider trace.TracerProvider, propagator propagation.TextMapPropagator) Tracer {
+	return &otelTracer{
+		tracer:     provider.Tracer(tracerName),
+		propagator: propagator,
+	}
+}
+
+func (t *otelTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, &otelSpan{span: span}
+}
+
+func (t *otelTracer) Inject(ctx context.Context, header http.Header) {
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) SetAttribute(key string, value interface{}) {
+	var kv attribute.KeyValue
+	switch v := value.(type) {
+	case string:
+		kv = attribute.String(key, v)
+	case []string:
+		kv = attribute.StringSlice(key, v)
+	case bool:
+		kv = attribute.Bool(key, v)
+	case int:
+		kv = attribute.Int(key, v)
+	case int64:
+		kv = attribute.Int64(key, v)
+	default:
+		kv = attribute.String(key, fmt.Sprint(v))
+	}
+
+	s.span.SetAttributes(kv)
+}
+
+func (s *otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,135 @@
+package pidalio
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+)
+
+type spanKey struct{}
+
+// fakeTracer records the spans started and their parents.
+type fakeTracer struct {
+	lock  sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	name       string
+	parent     string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &fakeSpan{name: name, attributes: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanKey{}).(*fakeSpan); ok {
+		span.parent = parent.name
+	}
+	t.spans = append(t.spans, span)
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *fakeTracer) Inject(ctx context.Context, header http.Header) {
+	if span, ok := ctx.Value(spanKey{}).(*fakeSpan); ok {
+		header.Set("traceparent", span.name)
+	}
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *fakeSpan) RecordError(err error)                      { s.err = err }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+func TestPolicyTransport_RoundTripTracing(t *testing.T) {
+	tracer := &fakeTracer{}
+	tr := &policyTransport{
+		policyEngine: &policyEngine{
+			initialized:       1,
+			overrideManager:   newTestOverrideManager(t),
+			policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+			tracer:            tracer,
+		},
+	}
+
+	var traceparent string
+	var sentCtx context.Context
+	tr.delegate = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		traceparent = req.Header.Get("traceparent")
+		sentCtx = req.Context()
+		return newResponse(http.StatusCreated, nil), nil
+	})
+
+	body := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","annotations":{}}}`
+	req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1/apis/apps/v1/namespaces/default/deployments", bytes.NewBufferString(body))
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+
+	if len(req.Header.Get("traceparent")) != 0 {
+		t.Errorf("RoundTrip() modified the headers of the original request")
+	}
+	if traceparent != "pidalio.RoundTrip" {
+		t.Errorf("trace context sent to delegate = %q, want pidalio.RoundTrip", traceparent)
+	}
+	if span, _ := sentCtx.Value(spanKey{}).(*fakeSpan); span == nil || span.name != "pidalio.RoundTrip" {
+		t.Errorf("context sent to delegate does not carry the request span")
+	}
+
+	want := []struct{ name, parent string }{
+		{"pidalio.RoundTrip", ""},
+		{"pidalio.RenderTemplates", "pidalio.RoundTrip"},
+		{"pidalio.ApplyOverridePolicies", "pidalio.RoundTrip"},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(tracer.spans), len(want))
+	}
+	for i, span := range tracer.spans {
+		if span.name != want[i].name || span.parent != want[i].parent {
+			t.Errorf("span[%d] = %s with parent %q, want %s with parent %q", i, span.name, span.parent, want[i].name, want[i].parent)
+		}
+		if !span.ended {
+			t.Errorf("span %s is not ended", span.name)
+		}
+	}
+
+	root := tracer.spans[0]
+	for key, value := range map[string]interface{}{
+		attrKind:        "Deployment",
+		attrNamespace:   "default",
+		attrOutcome:     outcomeMutated,
+		attrPolicyCount: 1,
+		attrPatchCount:  1,
+	} {
+		if root.attributes[key] != value {
+			t.Errorf("attribute %s = %v, want %v", key, root.attributes[key], value)
+		}
+	}
+	if policies, _ := tracer.spans[2].attributes[attrPolicies].([]string); len(policies) != 1 || policies[0] != "add-foo" {
+		t.Errorf("policies attribute = %v, want [add-foo]", tracer.spans[2].attributes[attrPolicies])
+	}
+}
+
+func TestNewOpenTelemetryTracer(t *testing.T) {
+	tracer := NewOpenTelemetryTracer(trace.NewNoopTracerProvider(), propagation.TraceContext{})
+
+	ctx, span := tracer.Start(context.Background(), "test")
+	span.SetAttribute(attrPatchCount, 1)
+	span.SetAttribute(attrKind, "Deployment")
+	span.SetAttribute(attrPolicies, []string{"add-foo"})
+	span.End()
+
+	header := http.Header{}
+	tracer.Inject(ctx, header)
+}
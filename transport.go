@@ -2,58 +2,122 @@ package pidalio
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	jsonpatch "github.com/evanphx/json-patch"
 	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 
+	"github.com/k-cloud-labs/pkg/client/listers/policy/v1alpha1"
 	"github.com/k-cloud-labs/pkg/utils"
+	"github.com/k-cloud-labs/pkg/utils/dynamiclister"
 	"github.com/k-cloud-labs/pkg/utils/interrupter"
 	"github.com/k-cloud-labs/pkg/utils/overridemanager"
+	"github.com/k-cloud-labs/pkg/utils/validatemanager"
 )
 
-type policyTransport struct {
-	delegate http.RoundTripper
-
+// policyEngine holds the policies shared by all the round trippers wrapped from the same rest.Config.
+type policyEngine struct {
 	overrideManager   overridemanager.OverrideManager
 	policyInterrupter interrupter.PolicyInterrupter
+	// listers build override managers applying the policies in the scope of a request.
+	drLister         dynamiclister.DynamicResourceLister
+	copLister        v1alpha1.ClusterOverridePolicyLister
+	opLister         v1alpha1.OverridePolicyLister
+	validateManager  validatemanager.ValidateManager
+	failurePolicy    *failurePolicyResolver
+	objectCache      *objectCache
+	oldObjectOptions OldObjectOptions
+	mutators         *mutatorRegistry
+	tracer           Tracer
+	exclusions       *exclusions
+	// pathPrefix is the prefix of request paths before /api or /apis, see requestPathPrefix.
+	pathPrefix string
+	// clientName and username identify the client together with the request, see ClientIdentity.
+	clientName   string
+	username     string
+	applyOptions ApplyOptions
+	// idempotentOverrides skips the policies already reflected in updated objects.
+	idempotentOverrides bool
+	events              *policyEvents
+	// crds passes requests through while the policy CRDs are missing.
+	crds   *crdWatcher
+	status *policyStatus
+	// clientSelectors caches the client selectors of policies, they are listed from the listers if it is nil.
+	clientSelectors *clientSelectors
+	// policyMetrics records the names of policies in the metrics.
+	policyMetrics bool
+	// warnedOverriders are the non-idempotent overriders warned about.
+	warnedOverriders sync.Map
+	// initialized is 1 once New has set up the engine, requests are passed through before, e.g. if New failed.
+	initialized int32
+}
+
+// isInitialized returns true once the engine is set up.
+func (e *policyEngine) isInitialized() bool {
+	return atomic.LoadInt32(&e.initialized) == 1
+}
+
+// policyTransport mutates requests by the shared policy engine and sends them to its own delegate.
+type policyTransport struct {
+	*policyEngine
+
+	delegate http.RoundTripper
 }
 
 var _ http.RoundTripper = &policyTransport{}
 
 // RegisterPolicyTransport init transport and register to wrapper.
+// It exits the process if the transport can not be set up, use New to handle errors instead.
+// Requests are passed through untouched until the policy CRDs are installed if they are missing.
 func RegisterPolicyTransport(config *rest.Config, stopCh chan struct{}) {
-	var (
-		p = &policyTransport{}
-		s = &setupManager{}
-	)
-	config.Wrap(p.Wrap)
-
-	if err := s.setupAll(config, stopCh); err != nil {
+	t, err := New(config, Options{AllowMissingCRDs: true})
+	if err != nil {
 		klog.Fatalf("setup transport failed with error=%v", err)
 	}
 
-	p.overrideManager = s.overrideManager
-	p.policyInterrupter = s.policyInterrupterManager
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	if err = t.Start(ctx); err != nil {
+		klog.Fatalf("start transport failed with error=%v", err)
+	}
 
-	if err := s.waitForCacheSync(); err != nil {
+	if err = t.WaitForSync(ctx); errors.Is(err, ErrPolicyCRDsMissing) {
+		klog.InfoS("policy CRDs are missing, policies are watched once they are installed.")
+	} else if err != nil {
 		klog.Fatalf("sync cache failed with error=%v", err)
 	} // wait sync policies
 }
 
-func (tr *policyTransport) Wrap(delegate http.RoundTripper) http.RoundTripper {
-	tr.delegate = delegate
-	return tr
+// Wrap returns a new round tripper which shares the policy engine and sends requests to delegate.
+// Every client built from the same rest.Config calls it with its own delegate, so the delegate must not be shared.
+func (e *policyEngine) Wrap(delegate http.RoundTripper) http.RoundTripper {
+	return &policyTransport{
+		policyEngine: e,
+		delegate:     delegate,
+	}
 }
 
 func (tr *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.Method != http.MethodPost && req.Method != http.MethodPatch && req.Method != http.MethodPut {
+	info := parseRequestInfo(req, tr.pathPrefix)
+	if !info.shouldMutate() || !tr.isInitialized() || tr.crds.isMissing() {
 		return tr.delegate.RoundTrip(req)
 	}
 
@@ -62,42 +126,303 @@ func (tr *policyTransport) RoundTrip(req *http.Request) (*http.Response, error)
 		return nil, err
 	}
 
-	unstructuredObj, err := bytesToUnstructured(bodyBytes)
+	ctx := req.Context()
+	if scope := policyScopeFrom(ctx); scope == nil || scope.client == nil {
+		ctx = WithClientIdentity(ctx, tr.clientIdentity(req))
+	}
+
+	ctx, span := startSpan(ctx, tr.tracer, "pidalio.RoundTrip")
+	defer span.End()
+	req = req.WithContext(ctx)
+	span.SetAttribute(attrVerb, info.Verb)
+	span.SetAttribute(attrNamespace, info.Namespace)
+	span.SetAttribute(attrName, info.Name)
+
+	start := time.Now()
+	rec := newMutationRecord(info)
+	defer rec.annotate(span)
+
+	var newBody, overrideFields []byte
+	switch {
+	case overridesDisabled(ctx):
+		klog.V(4).InfoS("skip mutating request without overrides.", "url", info.Path)
+		newBody = bodyBytes
+	case info.Verb == "patch" && isApplyPatch(req.Header.Get("Content-Type")):
+		newBody, overrideFields, err = tr.mutateApply(req, info, bodyBytes, rec)
+	case info.Verb == "patch":
+		newBody, err = tr.mutatePatch(req, info, bodyBytes, rec)
+	default:
+		newBody, err = tr.mutateObject(req, info, bodyBytes, rec)
+	}
 	if err != nil {
-		return nil, err
+		rec.outcome = outcomeError
+	}
+	// the duration is the latency added by mutating, the round trip to the apiserver is not observed.
+	rec.observe(info, time.Since(start), len(bodyBytes), tr.policyMetrics)
+
+	if err != nil {
+		span.RecordError(err)
+
+		var statusErr *apierrors.StatusError
+		if errors.As(err, &statusErr) {
+			return statusResponse(req, statusErr.ErrStatus)
+		}
+
+		if tr.failed(info, err) == Fail {
+			klog.ErrorS(err, "Failed to evaluate policies, reject the request.", "url", info.Path)
+			return statusResponse(req, newFailedCallingError(err).ErrStatus)
+		}
+
+		klog.ErrorS(err, "Failed to evaluate policies, send the original request.", "url", info.Path)
+		newBody = bodyBytes
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(newBody))
+	req.ContentLength = int64(len(newBody))
+
+	if tr.tracer != nil {
+		req = utilnet.CloneRequest(req)
+		tr.tracer.Inject(ctx, req.Header)
+	}
+
+	resp, err := tr.delegate.RoundTrip(req)
+	if err != nil || len(overrideFields) == 0 || resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return resp, err
+	}
+
+	fieldsResp, err := tr.applyOverrideFields(req, overrideFields)
+	if err != nil {
+		span.RecordError(err)
+		// the object of the caller is written already, the caller applies again on failure.
+		if tr.failed(info, err) == Fail {
+			klog.ErrorS(err, "Failed to apply fields set by overrides, reject the request.", "url", info.Path)
+			resp.Body.Close()
+			return statusResponse(req, newFailedCallingError(err).ErrStatus)
+		}
+
+		klog.ErrorS(err, "Failed to apply fields set by overrides, return the response of the caller.", "url", info.Path)
+		return resp, nil
+	}
+
+	resp.Body.Close()
+	return fieldsResp, nil
+}
+
+// failed records err evaluating policies on a request and returns the failure policy it resolves to.
+func (tr *policyTransport) failed(info *RequestInfo, err error) FailurePolicyType {
+	failurePolicy := tr.failurePolicy.defaultFailurePolicy()
+	var policyErr *policyError
+	if errors.As(err, &policyErr) {
+		failurePolicy = policyErr.failurePolicy
+	}
+
+	tr.status.failed(err)
+	policyErrors.WithLabelValues(info.GroupVersionResource().String(), info.Verb, string(failurePolicy)).Inc()
+	return failurePolicy
+}
+
+// mutateObject mutates the full object carried by a create or update body and returns the new body
+// encoded in the content type of the request. A body which can not be decoded is returned untouched.
+func (tr *policyTransport) mutateObject(req *http.Request, info *RequestInfo, body []byte, rec *mutationRecord) ([]byte, error) {
+	codec, ok := codecForContentType(req.Header.Get("Content-Type"))
+	if !ok {
+		klog.V(4).InfoS("skip mutating unsupported content type.", "contentType", req.Header.Get("Content-Type"), "url", info.Path)
+		return body, nil
+	}
+
+	unstructuredObj, err := codec.decode(body)
+	if err != nil {
+		klog.V(4).InfoS("skip mutating undecodable body.", "url", info.Path, "err", err)
+		return body, nil
+	}
+
+	if nonObjectKinds.Has(unstructuredObj.GetKind()) {
+		return body, nil
+	}
+	rec.gvk = unstructuredObj.GroupVersionKind()
+
+	// excluded objects are sent untouched, but they are validated still.
+	reason := tr.exclusions.excluded(unstructuredObj, info.Namespace)
+	if len(reason) != 0 {
+		klog.V(4).InfoS("skip mutating excluded object.", "url", info.Path, "reason", reason)
+		if tr.validateManager == nil {
+			return body, nil
+		}
 	}
 
 	var operation admissionv1.Operation
-	if req.Method == http.MethodPost {
+	if info.Verb == "create" {
 		operation = admissionv1.Create
 	} else {
 		operation = admissionv1.Update
 	}
 
-	patches, err := tr.policyInterrupter.OnMutating(unstructuredObj, nil, operation)
+	oldObj, err := tr.oldObject(req, info)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(patches) > 0 {
-		if err = applyJSONPatch(unstructuredObj, patches); err != nil {
+	defaultNamespace(unstructuredObj, info)
+	if len(reason) == 0 {
+		if err = tr.mutate(req.Context(), info, unstructuredObj, oldObj, operation, rec); err != nil {
 			return nil, err
 		}
+	}
+
+	if err = tr.validate(req.Context(), info, unstructuredObj, oldObj, operation); err != nil {
+		return nil, err
+	}
+
+	if len(reason) != 0 {
+		return body, nil
+	}
+	return codec.encode(unstructuredObj)
+}
+
+// defaultNamespace sets the namespace from the url if the object leaves it out,
+// so namespaced policies can match it the same way as the apiserver sees it.
+func defaultNamespace(obj *unstructured.Unstructured, info *RequestInfo) {
+	if len(obj.GetNamespace()) != 0 || len(info.Namespace) == 0 || info.Resource == "namespaces" {
+		return
+	}
+
+	obj.SetNamespace(info.Namespace)
+}
+
+// mutate renders policy templates if obj is a policy, otherwise applies mutators and override policies to obj.
+// oldObj is the current state of obj on update, it may be nil if it is not resolved.
+// The outcome and the policies applied are reported to rec.
+func (tr *policyTransport) mutate(ctx context.Context, info *RequestInfo, obj, oldObj *unstructured.Unstructured,
+	operation admissionv1.Operation, rec *mutationRecord) error {
+	_, renderSpan := startSpan(ctx, tr.tracer, "pidalio.RenderTemplates")
+	start := time.Now()
+	patches, err := tr.policyInterrupter.OnMutating(obj, oldObj, operation)
+	observeCueEvaluation(cueStageRender, start)
+	renderSpan.SetAttribute(attrPatchCount, len(patches))
+	if err != nil {
+		renderSpan.RecordError(err)
+	}
+	renderSpan.End()
+	if err != nil {
+		return err
+	}
+
+	rec.outcome = outcomeUnchanged
+	if len(patches) > 0 {
+		rec.outcome = outcomeMutated
+		rec.patchCount = len(patches)
+		return applyJSONPatch(obj, patches)
+	}
+
+	var received *unstructured.Unstructured
+	if tr.tracer != nil {
+		received = obj.DeepCopy()
+	}
+
+	before, err := tr.mutators.mutate(ctx, tr.tracer, BeforePolicies, *info, obj, oldObj)
+	if err != nil {
+		return err
+	}
+
+	original := obj.DeepCopy()
+	cops, ops, err := tr.applyOverridePolicies(ctx, obj, oldObj, operation)
+	if err != nil {
+		klog.ErrorS(err, "Failed to apply overrides.", "resource", klog.KObj(obj))
+		failurePolicy, failed := tr.failurePolicy.withScope(policyScopeFrom(ctx)).resolve(original, oldObj, operation)
+		tr.events.failed(original, operation, failed, err)
+		return &policyError{err: err, failurePolicy: failurePolicy}
+	}
+
+	after, err := tr.mutators.mutate(ctx, tr.tracer, AfterPolicies, *info, obj, oldObj)
+	if err != nil {
+		return err
+	}
+
+	if cops, err = withMutators(before, cops, after); err != nil {
+		return err
+	}
+
+	for _, policy := range appliedPolicies(cops) {
+		rec.policies = append(rec.policies, policy.name)
+	}
+	for _, policy := range appliedPolicies(ops) {
+		rec.policies = append(rec.policies, obj.GetNamespace()+"/"+policy.name)
+	}
+	if len(rec.policies) > 0 {
+		rec.outcome = outcomeMutated
+	}
+	if received != nil {
+		rec.patchCount = countPatch(received, obj)
+	}
+
+	return setAppliedOverrides(obj, cops, ops)
+}
+
+// applyOverridePolicies applies the override policies in the scope of ctx in a span. Policies are evaluated together,
+// so the policies applied are attributes of the span rather than spans of their own.
+func (tr *policyTransport) applyOverridePolicies(ctx context.Context, obj, oldObj *unstructured.Unstructured,
+	operation admissionv1.Operation) (*overridemanager.AppliedOverrides, *overridemanager.AppliedOverrides, error) {
+	ctx, span := startSpan(ctx, tr.tracer, "pidalio.ApplyOverridePolicies")
+	defer span.End()
+
+	manager := tr.overrideManager
+	scope := policyScopeFrom(ctx)
+	if tr.scoped(scope) {
+		manager = tr.scopedOverrideManager(scope)
+	}
+
+	start := time.Now()
+	var (
+		cops, ops *overridemanager.AppliedOverrides
+		skipped   sets.String
+		err       error
+	)
+	if tr.idempotentOverrides && operation == admissionv1.Update {
+		cops, ops, skipped, err = tr.applyOverridePoliciesOnce(manager, scope, obj, oldObj, operation)
 	} else {
-		if err = ApplyOverridePolicy(tr.overrideManager, unstructuredObj, operation); err != nil {
-			return nil, err
+		cops, ops, err = manager.ApplyOverridePolicies(obj, oldObj, operation)
+	}
+	observeCueEvaluation(cueStageOverride, start)
+	if err != nil {
+		span.RecordError(err)
+		return nil, nil, err
+	}
+	if operation == admissionv1.Update {
+		tr.warnNonIdempotentOverrides(obj, cops, ops, skipped)
+	}
+	tr.events.applied(obj, operation, cops, ops, skipped)
+
+	if tr.tracer != nil {
+		var names []string
+		for _, policy := range appliedPolicies(cops) {
+			names = append(names, policy.name)
+		}
+		for _, policy := range appliedPolicies(ops) {
+			names = append(names, obj.GetNamespace()+"/"+policy.name)
 		}
+		span.SetAttribute(attrPolicies, names)
 	}
 
-	newBody, err := unstructuredObj.MarshalJSON()
+	return cops, ops, nil
+}
+
+// countPatch returns the number of json patch operations from original to mutated, or -1 if it is not known.
+func countPatch(original, mutated *unstructured.Unstructured) int {
+	originalBytes, err := original.MarshalJSON()
 	if err != nil {
-		return nil, err
+		return -1
+	}
+	mutatedBytes, err := mutated.MarshalJSON()
+	if err != nil {
+		return -1
 	}
 
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(newBody))
-	req.ContentLength = int64(len(newBody))
+	patch, err := jsonpatchv2.CreatePatch(originalBytes, mutatedBytes)
+	if err != nil {
+		return -1
+	}
 
-	return tr.delegate.RoundTrip(req)
+	return len(patch)
 }
 
 func ApplyOverridePolicy(manager overridemanager.OverrideManager, unstructuredObj *unstructured.Unstructured, operation admissionv1.Operation) error {
@@ -107,13 +432,34 @@ func ApplyOverridePolicy(manager overridemanager.OverrideManager, unstructuredOb
 		return err
 	}
 
-	annotations, err := recordAppliedOverrides(cops, ops, unstructuredObj.GetAnnotations())
+	return setAppliedOverrides(unstructuredObj, cops, ops)
+}
+
+// ApplyOverridePolicyIdempotent is ApplyOverridePolicy which applies nothing on update if all the policies are already
+// reflected in the object, see Options.IdempotentOverrides. Otherwise, all of them are applied again.
+func ApplyOverridePolicyIdempotent(manager overridemanager.OverrideManager, unstructuredObj *unstructured.Unstructured, operation admissionv1.Operation) error {
+	if operation != admissionv1.Update {
+		return ApplyOverridePolicy(manager, unstructuredObj, operation)
+	}
+
+	cops, ops, _, err := (&policyEngine{}).applyOverridePoliciesOnce(manager, nil, unstructuredObj, nil, operation)
+	if err != nil {
+		klog.ErrorS(err, "Failed to apply overrides.", "resource", klog.KObj(unstructuredObj))
+		return err
+	}
+
+	return setAppliedOverrides(unstructuredObj, cops, ops)
+}
+
+// setAppliedOverrides records the applied overrides in the annotations of obj.
+func setAppliedOverrides(obj *unstructured.Unstructured, cops, ops *overridemanager.AppliedOverrides) error {
+	annotations, err := recordAppliedOverrides(cops, ops, obj.GetAnnotations())
 	if err != nil {
-		klog.ErrorS(err, "failed to record appliedOverrides.", klog.KObj(unstructuredObj))
+		klog.ErrorS(err, "failed to record appliedOverrides.", klog.KObj(obj))
 		return err
 	}
 
-	unstructuredObj.SetAnnotations(annotations)
+	obj.SetAnnotations(annotations)
 
 	return nil
 }
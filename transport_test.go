@@ -1,7 +1,13 @@
 package pidalio
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -11,8 +17,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
 
 	"github.com/k-cloud-labs/pkg/utils"
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
 	"github.com/k-cloud-labs/pkg/utils/overridemanager"
 	"github.com/k-cloud-labs/pkg/utils/util"
 
@@ -238,3 +246,67 @@ func Test_bytesToUnstructured(t *testing.T) {
 		})
 	}
 }
+
+func TestPolicyEngine_Wrap(t *testing.T) {
+	engine := &policyEngine{
+		initialized:       1,
+		overrideManager:   newTestOverrideManager(t),
+		policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+	}
+
+	config := &rest.Config{Host: "https://127.0.0.1:6443"}
+	config.Wrap(engine.Wrap)
+
+	const (
+		clients  = 4
+		requests = 50
+	)
+	var (
+		counts     [clients]int32
+		transports [clients]http.RoundTripper
+	)
+	for i := range transports {
+		i := i
+		clientConfig := rest.CopyConfig(config)
+		clientConfig.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if got := req.Header.Get("X-Client"); got != strconv.Itoa(i) {
+				t.Errorf("request of client %s is sent by the transport of client %d", got, i)
+			}
+			body, _ := ioutil.ReadAll(req.Body)
+			if obj, err := bytesToUnstructured(body); err != nil || obj.GetAnnotations()["foo"] != "bar" {
+				t.Errorf("request of client %d is not mutated, body = %s", i, body)
+			}
+			atomic.AddInt32(&counts[i], 1)
+			return newResponse(http.StatusCreated, nil), nil
+		})
+
+		rt, err := rest.TransportFor(clientConfig)
+		if err != nil {
+			t.Fatalf("TransportFor() error = %v", err)
+		}
+		transports[i] = rt
+	}
+
+	var wg sync.WaitGroup
+	for i := range transports {
+		for j := 0; j < requests; j++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				body := `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","annotations":{}}}`
+				req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1:6443/apis/apps/v1/namespaces/default/deployments", bytes.NewBufferString(body))
+				req.Header.Set("X-Client", strconv.Itoa(i))
+				if _, err := transports[i].RoundTrip(req); err != nil {
+					t.Errorf("RoundTrip() error = %v", err)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+
+	for i := range counts {
+		if counts[i] != requests {
+			t.Errorf("transport of client %d sent %d requests, want %d", i, counts[i], requests)
+		}
+	}
+}
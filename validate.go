@@ -0,0 +1,70 @@
+package pidalio
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+// admissionName is the name reported in denial messages, like a webhook name of the apiserver.
+const admissionName = "pidalio"
+
+// validate evaluates validate policies on the mutated obj. It returns a StatusError with the same
+// status the apiserver returns when an admission webhook denies the request.
+func (tr *policyTransport) validate(ctx context.Context, info *RequestInfo, obj, oldObj *unstructured.Unstructured, operation admissionv1.Operation) error {
+	if tr.validateManager == nil {
+		return nil
+	}
+
+	_, span := startSpan(ctx, tr.tracer, "pidalio.ValidatePolicies")
+	defer span.End()
+
+	// validates the policy itself if obj is a policy.
+	if err := tr.policyInterrupter.OnValidating(obj, oldObj, operation); err != nil {
+		span.RecordError(err)
+		return newAdmissionError(info, obj, http.StatusUnprocessableEntity, metav1.StatusReasonInvalid, err.Error())
+	}
+
+	result, err := tr.validateManager.ApplyValidatePolicies(obj, oldObj, operation)
+	if err != nil {
+		klog.ErrorS(err, "Failed to apply validate policies.", "resource", klog.KObj(obj))
+		span.RecordError(err)
+		return err
+	}
+
+	if !result.Valid {
+		klog.V(2).InfoS("request is denied by validate policies.", "resource", klog.KObj(obj), "reason", result.Reason)
+		span.SetAttribute("pidalio.denied", true)
+		return newAdmissionError(info, obj, http.StatusForbidden, metav1.StatusReasonForbidden, result.Reason)
+	}
+
+	return nil
+}
+
+// newAdmissionError returns a StatusError which looks like an admission webhook denial of the apiserver.
+func newAdmissionError(info *RequestInfo, obj *unstructured.Unstructured, code int32, reason metav1.StatusReason, message string) *apierrors.StatusError {
+	deniedBy := fmt.Sprintf("admission webhook %q denied the request", admissionName)
+	if len(message) == 0 {
+		message = deniedBy + " without explanation"
+	} else {
+		message = deniedBy + ": " + message
+	}
+
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  reason,
+		Message: message,
+		Details: &metav1.StatusDetails{
+			Name:  obj.GetName(),
+			Group: info.APIGroup,
+			Kind:  info.Resource,
+		},
+	}}
+}
@@ -0,0 +1,91 @@
+package pidalio
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/k-cloud-labs/pkg/utils/interrupter"
+	"github.com/k-cloud-labs/pkg/utils/validatemanager"
+)
+
+// fakeValidateManager denies objects without label app.
+type fakeValidateManager struct{}
+
+func (fakeValidateManager) ApplyValidatePolicies(rawObj, oldObj *unstructured.Unstructured, operation admissionv1.Operation) (*validatemanager.ValidateResult, error) {
+	if _, ok := rawObj.GetLabels()["app"]; !ok {
+		return &validatemanager.ValidateResult{Valid: false, Reason: "label app is required"}, nil
+	}
+	return &validatemanager.ValidateResult{Valid: true}, nil
+}
+
+func TestPolicyTransport_RoundTripValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantMessage string
+	}{
+		{
+			name:     "allowed",
+			body:     `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","labels":{"app":"web"},"annotations":{}}}`,
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:        "denied",
+			body:        `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web","namespace":"default","annotations":{}}}`,
+			wantCode:    http.StatusForbidden,
+			wantMessage: `admission webhook "pidalio" denied the request: label app is required`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent bool
+			tr := &policyTransport{
+				policyEngine: &policyEngine{
+					initialized:       1,
+					overrideManager:   newTestOverrideManager(t),
+					policyInterrupter: interrupter.NewPolicyInterrupterManager(),
+					validateManager:   fakeValidateManager{},
+				},
+				delegate: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+					sent = true
+					return newResponse(http.StatusCreated, nil), nil
+				}),
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, "https://127.0.0.1/apis/apps/v1/namespaces/default/deployments", bytes.NewBufferString(tt.body))
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Fatalf("RoundTrip() status code = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if sent != (tt.wantCode == http.StatusCreated) {
+				t.Errorf("RoundTrip() sent request = %v", sent)
+			}
+			if len(tt.wantMessage) == 0 {
+				return
+			}
+
+			body, _ := ioutil.ReadAll(resp.Body)
+			status := metav1.Status{}
+			if err = json.Unmarshal(body, &status); err != nil {
+				t.Fatalf("failed to decode status %s: %v", body, err)
+			}
+			if status.Kind != "Status" || status.Reason != metav1.StatusReasonForbidden || status.Message != tt.wantMessage {
+				t.Errorf("RoundTrip() status = %+v, want message %q", status, tt.wantMessage)
+			}
+			if status.Details == nil || status.Details.Name != "web" || status.Details.Kind != "deployments" {
+				t.Errorf("RoundTrip() status details = %+v", status.Details)
+			}
+		})
+	}
+}